@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var flushInterval = flag.Duration("flush-interval", time.Minute, "How often the open indexes are flushed to disk.")
+var flushBytes = flag.Int64("flush-bytes", 64<<20, "Flush as soon as an index has this many unflushed bytes.")
+
+// checkpointStats reports the state of the checkpointer.
+type checkpointStats struct {
+	Checkpoints  int64     `json:"checkpoints"`
+	Errors       int64     `json:"errors"`
+	Running      bool      `json:"running"`
+	LastStart    time.Time `json:"last_start"`
+	LastDuration float64   `json:"last_duration_ms"`
+	LastFlushed  int       `json:"last_flushed_indexes"`
+	LastSuccess  time.Time `json:"last_success"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// checkpointer flushes the open indexes in the background, on every interval
+// and whenever an index has more unflushed bytes than -flush-bytes.
+type checkpointer struct {
+	// flush flushes the indexes and returns how many were flushed.
+	flush func() (int, error)
+
+	kick chan struct{}
+	quit chan struct{}
+	done chan struct{}
+
+	lock  sync.Mutex
+	stats checkpointStats
+}
+
+var checkpoints = newCheckpointer(dbflush)
+
+func newCheckpointer(flush func() (int, error)) *checkpointer {
+	return &checkpointer{
+		flush: flush,
+		kick:  make(chan struct{}, 1),
+		quit:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+func (c *checkpointer) run(interval time.Duration) {
+	defer close(c.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.checkpoint()
+		case <-c.kick:
+			c.checkpoint()
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// notify asks for a checkpoint without waiting for the next interval.
+func (c *checkpointer) notify() {
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+}
+
+// stop waits for a running checkpoint and stops the loop.
+func (c *checkpointer) stop() {
+	close(c.quit)
+	<-c.done
+}
+
+func (c *checkpointer) checkpoint() error {
+	start := time.Now()
+	c.lock.Lock()
+	c.stats.Running = true
+	c.stats.LastStart = start
+	c.lock.Unlock()
+
+	flushed, err := c.flush()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stats.Running = false
+	c.stats.Checkpoints++
+	c.stats.LastDuration = float64(time.Since(start)) / float64(time.Millisecond)
+	c.stats.LastFlushed = flushed
+	if err != nil {
+		c.stats.Errors++
+		c.stats.LastError = err.Error()
+		return err
+	}
+	c.stats.LastSuccess = time.Now()
+	c.stats.LastError = ""
+	return nil
+}
+
+func (c *checkpointer) info() checkpointStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+func checkpointInfo(args []string, w http.ResponseWriter, req *http.Request) {
+	render(200, w, checkpoints.info())
+}
+
+// shutdown stops the checkpointer and flushes and closes every open index.
+func shutdown() {
+	checkpoints.stop()
+	if err := checkpoints.checkpoint(); err != nil {
+		log.Printf("Error flushing on shutdown: %v", err)
+	}
+	dbcloseAll()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"github.com/vimrus/tickdb/storage"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// checkpointDB creates a database and replaces the checkpointer and
+// -flush-bytes for the test, the indexes are closed when it ends.
+func checkpointDB(t *testing.T, bytes int64) string {
+	path := filepath.Join(t.TempDir(), "db")
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	c, n := checkpoints, *flushBytes
+	checkpoints, *flushBytes = newCheckpointer(dbflush), bytes
+	t.Cleanup(func() {
+		dbcloseAll()
+		checkpoints, *flushBytes = c, n
+	})
+	return path
+}
+
+// storeRows stores n points a minute apart in index.
+func storeRows(t *testing.T, path, index string, n int) {
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC)
+	var data []PostData
+	for i := 0; i < n; i++ {
+		data = append(data, PostData{
+			Time:  base.Add(time.Duration(i) * time.Minute).Format(time.RFC3339),
+			Index: index,
+			Value: map[string]float64{"price": float64(i)},
+		})
+	}
+	if err := dbstore(path, 0, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitCheckpoint waits until the checkpointer has done a checkpoint and the
+// index has no unflushed bytes.
+func waitCheckpoint(t *testing.T, db *storage.DB) checkpointStats {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := checkpoints.info()
+		if stats.Checkpoints > 0 && db.DirtyBytes() == 0 {
+			return stats
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no checkpoint, %d unflushed bytes: %+v", db.DirtyBytes(), stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCheckpointFlushBytes(t *testing.T) {
+	path := checkpointDB(t, 1<<10)
+
+	// A store below -flush-bytes does not ask for a checkpoint.
+	storeRows(t, path, "ticks", 1)
+	db, err := dbconn(path, "ticks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.DirtyBytes() == 0 {
+		t.Fatal("expected unflushed bytes")
+	}
+	if len(checkpoints.kick) != 0 {
+		t.Fatal("unexpected checkpoint request")
+	}
+
+	storeRows(t, path, "ticks", 100)
+	if db.DirtyBytes() < *flushBytes {
+		t.Fatalf("expected at least %d unflushed bytes, got %d", *flushBytes, db.DirtyBytes())
+	}
+	if len(checkpoints.kick) != 1 {
+		t.Fatal("expected a checkpoint request")
+	}
+
+	// The interval is too long to trigger the checkpoint.
+	start := time.Now()
+	go checkpoints.run(time.Hour)
+	defer checkpoints.stop()
+	stats := waitCheckpoint(t, db)
+	if stats.Checkpoints != 1 || stats.Errors != 0 || stats.LastFlushed != 1 || stats.LastError != "" {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.LastSuccess.Before(start) || stats.LastStart.Before(start) {
+		t.Fatalf("unexpected times %+v", stats)
+	}
+}
+
+func TestCheckpointInterval(t *testing.T) {
+	path := checkpointDB(t, 64<<20)
+	storeRows(t, path, "ticks", 10)
+	db, err := dbconn(path, "ticks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(checkpoints.kick) != 0 {
+		t.Fatal("unexpected checkpoint request")
+	}
+
+	go checkpoints.run(10 * time.Millisecond)
+	defer checkpoints.stop()
+	if stats := waitCheckpoint(t, db); stats.Errors != 0 || stats.LastSuccess.IsZero() {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if p, err := db.Get(time.Date(2016, 8, 28, 0, 9, 0, 0, time.UTC).UnixNano()); err != nil {
+		t.Fatal(err)
+	} else if p.Value["price"] != 9 {
+		t.Fatalf("unexpected value %v", p.Value)
+	}
+}
+
+func TestCheckpointError(t *testing.T) {
+	errFlush := errors.New("flush failed")
+	c := newCheckpointer(func() (int, error) {
+		return 1, errFlush
+	})
+	if err := c.checkpoint(); err != errFlush {
+		t.Fatalf("expected %v, got %v", errFlush, err)
+	}
+	stats := c.info()
+	if stats.Checkpoints != 1 || stats.Errors != 1 || stats.LastError != errFlush.Error() || stats.Running {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if !stats.LastSuccess.IsZero() {
+		t.Fatalf("unexpected success at %v", stats.LastSuccess)
+	}
+
+	// A successful checkpoint clears the last error, but keeps the count.
+	c.flush = func() (int, error) {
+		return 2, nil
+	}
+	if err := c.checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	stats = c.info()
+	if stats.Checkpoints != 2 || stats.Errors != 1 || stats.LastError != "" || stats.LastFlushed != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.LastSuccess.IsZero() {
+		t.Fatal("expected a success time")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	path := checkpointDB(t, 64<<20)
+	storeRows(t, path, "ticks", 10)
+	db, err := dbconn(path, "ticks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go checkpoints.run(time.Hour)
+
+	shutdown()
+	if stats := checkpoints.info(); stats.Checkpoints != 1 || stats.LastFlushed != 1 || stats.Errors != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if db.Opened() {
+		t.Fatal("expected the index to be closed")
+	}
+	if len(dbConns) != 0 || len(dbTxLogs) != 0 {
+		t.Fatal("expected no open databases")
+	}
+
+	// The points are in the index file, the log is empty.
+	if fi, err := os.Stat(path + "/ticks" + storage.WALSuffix); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != 0 {
+		t.Fatalf("expected empty log after shutdown, got %d bytes", fi.Size())
+	}
+	db, err = dbconn(path, "ticks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(time.Date(2016, 8, 28, 0, 9, 0, 0, time.UTC).UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+}
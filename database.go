@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 var (
@@ -15,18 +16,50 @@ var (
 	ErrDBExists    = errors.New("Database exists")
 	ErrDBCreate    = errors.New("Create database failed")
 	ErrKeyNotFound = errors.New("Key not found")
+	ErrSyncPolicy  = errors.New("Unknown sync policy")
+	ErrGroup       = errors.New("Unknown group")
+	ErrWeekStart   = errors.New("Unknown week start")
+	ErrFill        = errors.New("Unknown fill")
+	ErrFields      = errors.New("Invalid fields")
+	ErrExpression  = errors.New("Invalid expression")
+	ErrWindow      = errors.New("Invalid window")
+	ErrOrder       = errors.New("Unknown order")
 )
 
 type indexConns map[string]*storage.DB
 
 var dbConns = make(map[string]indexConns)
 
+// dbTxLogs holds the transaction log of every database in dbConns.
+var dbTxLogs = make(map[string]*storage.TxLog)
+
+// connsLock protects dbConns and dbTxLogs, the indexes lock themselves.
+var connsLock sync.Mutex
+
+// txLogName is the file name of the transaction log in a database directory.
+const txLogName = ".txlog"
+
+// dbOptions are passed to storage.Open for every index.
+var dbOptions = storage.DefaultOptions
+
 type PostData struct {
 	Time  string             `json:"time"`
 	Index string             `json:"index"`
 	Value map[string]float64 `json:"value"`
 }
 
+func parseSyncPolicy(policy string) (storage.SyncPolicy, error) {
+	switch policy {
+	case "always":
+		return storage.SyncAlways, nil
+	case "interval":
+		return storage.SyncInterval, nil
+	case "never":
+		return storage.SyncNever, nil
+	}
+	return 0, ErrSyncPolicy
+}
+
 func dbcreate(path string) error {
 	if _, err := os.Stat(path); err == nil {
 		return ErrDBExists
@@ -47,43 +80,92 @@ func dbopen(path string) error {
 }
 
 func dbconn(path, index string) (*storage.DB, error) {
-	if _, ok := dbConns[path]; !ok {
-		if err := dbopen(path); err != nil {
-			return nil, err
-		}
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	txlog, err := dbtxlog(path)
+	if err != nil {
+		return nil, err
+	}
+	conns := dbConns[path]
+	if idx, ok := conns[index]; ok {
+		return idx, nil
+	}
 
-		idx, err := storage.Open(path + "/" + index)
-		dbConns[path] = make(map[string]*storage.DB)
-		dbConns[path][index] = idx
-		return idx, err
+	options := *dbOptions
+	options.TxLog = txlog
+	idx, err := storage.Open(path+"/"+index, &options)
+	if err != nil {
+		return nil, err
 	}
+	conns[index] = idx
+	return idx, nil
+}
 
-	if idx, ok := dbConns[path][index]; !ok {
-		var err error
-		idx, err = storage.Open(path + "/" + index)
-		dbConns[path][index] = idx
-		return idx, err
+// dbtxlog returns the transaction log of the database, it is opened before
+// any index of the database, as they need it to replay their logs.
+// connsLock must be held.
+func dbtxlog(path string) (*storage.TxLog, error) {
+	if txlog, ok := dbTxLogs[path]; ok {
+		return txlog, nil
+	}
+	if err := dbopen(path); err != nil {
+		return nil, err
 	}
 
-	return dbConns[path][index], nil
+	txlog, err := storage.OpenTxLog(path+"/"+txLogName, dbOptions)
+	if err != nil {
+		return nil, err
+	}
+	dbTxLogs[path] = txlog
+	dbConns[path] = make(indexConns)
+	return txlog, nil
 }
 
 func dbstore(path string, k int64, data []PostData) error {
+	// Group the rows by index, so every index is written with one batch.
+	var indexes []string
+	batches := make(map[string][]storage.Point)
 	for _, row := range data {
-		storage, dbErr := dbconn(path, row.Index)
-
-		if dbErr != nil {
-			return dbErr
-		}
-
 		t, err := timelib.ParseTime(row.Time)
 		if err != nil {
 			return err
 		}
+		if _, ok := batches[row.Index]; !ok {
+			indexes = append(indexes, row.Index)
+		}
+		batches[row.Index] = append(batches[row.Index], storage.Point{
+			Timestamp: t.UnixNano(),
+			Value:     row.Value,
+		})
+	}
 
-		err = storage.Put(t.UnixNano(), row.Value)
-		if err != nil {
-			return nil
+	// Write all indexes in one transaction, so the body lands fully or not at all.
+	connsLock.Lock()
+	txlog, err := dbtxlog(path)
+	connsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tx := txlog.Begin()
+	var dbs []*storage.DB
+	for _, index := range indexes {
+		db, dbErr := dbconn(path, index)
+		if dbErr != nil {
+			tx.Rollback()
+			return dbErr
+		}
+		tx.PutBatch(db, batches[index])
+		dbs = append(dbs, db)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, db := range dbs {
+		if db.DirtyBytes() >= *flushBytes {
+			checkpoints.notify()
 		}
 	}
 	return nil
@@ -112,8 +194,55 @@ func dbquery(path string, query Query) (interface{}, error) {
 	return execQuery(db, query)
 }
 
+func dbcandles(path string, query CandlesQuery) (interface{}, error) {
+	db, dbErr := dbconn(path, query.Index)
+
+	if dbErr != nil {
+		return nil, dbErr
+	}
+
+	return execCandles(db, query)
+}
+
+func indexcompact(path, index string) (int64, int64, error) {
+	db, dbErr := dbconn(path, index)
+	if dbErr != nil {
+		return 0, 0, dbErr
+	}
+	before, after, err := db.Vacuum()
+	if err != nil && !db.Opened() {
+		// The vacuum closed the index, the next dbconn opens it again.
+		connsLock.Lock()
+		if dbConns[path][index] == db {
+			delete(dbConns[path], index)
+		}
+		connsLock.Unlock()
+	}
+	return before, after, err
+}
+
+// dbdelete closes the indexes and the transaction log of the database before
+// its directory is removed.
 func dbdelete(path string) error {
-	return os.Remove(path)
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	if err := dbopen(path); err != nil {
+		return err
+	}
+	for index, db := range dbConns[path] {
+		if err := db.Close(); err != nil {
+			log.Printf("Error closing %s: %v", path+"/"+index, err)
+		}
+	}
+	delete(dbConns, path)
+	if txlog, ok := dbTxLogs[path]; ok {
+		if err := txlog.Close(); err != nil {
+			log.Printf("Error closing %s: %v", path+"/"+txLogName, err)
+		}
+		delete(dbTxLogs, path)
+	}
+	return os.RemoveAll(path)
 }
 
 func dblist(root string) []string {
@@ -143,8 +272,25 @@ func dbBase(path string) string {
 	return path[left:right]
 }
 
+// indexdelete closes the index before its files are removed, otherwise the
+// open handle would keep serving the removed file.
 func indexdelete(path, index string) error {
-	return os.Remove(path + "/" + index)
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	if db, ok := dbConns[path][index]; ok {
+		if err := db.Close(); err != nil {
+			log.Printf("Error closing %s: %v", path+"/"+index, err)
+		}
+		delete(dbConns[path], index)
+	}
+	if err := os.Remove(path + "/" + index); err != nil {
+		return err
+	}
+	if err := os.Remove(path + "/" + index + storage.WALSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 func pointremove(path, index string, from, to int64) error {
@@ -152,6 +298,66 @@ func pointremove(path, index string, from, to int64) error {
 	if dbErr != nil {
 		return dbErr
 	}
-	storage.Delete(from, to)
-	return nil
+	return storage.Delete(from, to)
+}
+
+// openIndex is an index listed by dbindexes.
+type openIndex struct {
+	name string
+	db   *storage.DB
+}
+
+// dbindexes returns the open indexes, so they can be used without holding
+// connsLock.
+func dbindexes() []openIndex {
+	connsLock.Lock()
+	defer connsLock.Unlock()
+
+	var list []openIndex
+	for path, conns := range dbConns {
+		for index, db := range conns {
+			list = append(list, openIndex{path + "/" + index, db})
+		}
+	}
+	return list
+}
+
+// dbflush flushes every open index with unflushed changes, the first error
+// is returned after all indexes were tried.
+func dbflush() (int, error) {
+	var flushErr error
+	flushed := 0
+	for _, idx := range dbindexes() {
+		if idx.db.DirtyBytes() == 0 {
+			continue
+		}
+		if err := idx.db.Flush(); err != nil {
+			log.Printf("Error flushing %s: %v", idx.name, err)
+			if flushErr == nil {
+				flushErr = err
+			}
+			continue
+		}
+		flushed++
+	}
+	return flushed, flushErr
+}
+
+// dbcloseAll closes every open index.
+func dbcloseAll() {
+	for _, idx := range dbindexes() {
+		if err := idx.db.Close(); err != nil {
+			log.Printf("Error closing %s: %v", idx.name, err)
+		}
+	}
+
+	connsLock.Lock()
+	defer connsLock.Unlock()
+	for path, txlog := range dbTxLogs {
+		if err := txlog.Close(); err != nil {
+			log.Printf("Error closing %s: %v", path+"/"+txLogName, err)
+		}
+	}
+	dbConns = make(map[string]indexConns)
+	dbTxLogs = make(map[string]*storage.TxLog)
 }
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"github.com/vimrus/tickdb/storage"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expr is a computed field of a query, evaluated on the reduced fields of a
+// bucket.
+type expr interface {
+	// eval returns the value of the expression, false if a field it needs
+	// is missing in the bucket.
+	eval(lookup func(fieldRef) (float64, bool)) (float64, bool)
+}
+
+// fieldRef is a field reduced by a reducer.
+type fieldRef struct {
+	field   string
+	reducer string
+}
+
+type numberExpr float64
+
+type fieldExpr fieldRef
+
+type negExpr struct {
+	x expr
+}
+
+type binaryExpr struct {
+	op   byte
+	x, y expr
+}
+
+type callExpr struct {
+	fn   string
+	args []expr
+}
+
+// mathFuncs are the functions of expressions and their number of arguments,
+// other names called with a field are reducers.
+var mathFuncs = map[string]int{
+	"abs":  1,
+	"log":  1,
+	"sqrt": 1,
+	"pow":  2,
+}
+
+func (e numberExpr) eval(lookup func(fieldRef) (float64, bool)) (float64, bool) {
+	return float64(e), true
+}
+
+func (e fieldExpr) eval(lookup func(fieldRef) (float64, bool)) (float64, bool) {
+	return lookup(fieldRef(e))
+}
+
+func (e negExpr) eval(lookup func(fieldRef) (float64, bool)) (float64, bool) {
+	x, ok := e.x.eval(lookup)
+	return -x, ok
+}
+
+func (e binaryExpr) eval(lookup func(fieldRef) (float64, bool)) (float64, bool) {
+	x, ok := e.x.eval(lookup)
+	if !ok {
+		return 0, false
+	}
+	y, ok := e.y.eval(lookup)
+	if !ok {
+		return 0, false
+	}
+	switch e.op {
+	case '+':
+		return x + y, true
+	case '-':
+		return x - y, true
+	case '*':
+		return x * y, true
+	}
+	return x / y, true
+}
+
+func (e callExpr) eval(lookup func(fieldRef) (float64, bool)) (float64, bool) {
+	args := make([]float64, len(e.args))
+	for i, arg := range e.args {
+		v, ok := arg.eval(lookup)
+		if !ok {
+			return 0, false
+		}
+		args[i] = v
+	}
+	switch e.fn {
+	case "abs":
+		return math.Abs(args[0]), true
+	case "log":
+		return math.Log(args[0]), true
+	case "sqrt":
+		return math.Sqrt(args[0]), true
+	}
+	return math.Pow(args[0], args[1]), true
+}
+
+// exprParser parses an expression like "(max(high) - min(low)) / close".
+// A name alone is the field fieldRef returns for it, a reducer called with
+// a field reduces it.
+type exprParser struct {
+	src      string
+	pos      int
+	fieldRef func(string) fieldRef
+	refs     []fieldRef
+}
+
+// parseExpr parses an expression and returns the fields it needs.
+func parseExpr(src string, ref func(string) fieldRef) (expr, []fieldRef, error) {
+	p := &exprParser{src: src, fieldRef: ref}
+	e, err := p.parseSum()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.peek() != 0 {
+		return nil, nil, ErrExpression
+	}
+	return e, p.refs, nil
+}
+
+// peek returns the next character which is not a space, 0 at the end.
+func (p *exprParser) peek() byte {
+	for p.pos < len(p.src) && p.src[p.pos] == ' ' {
+		p.pos++
+	}
+	if p.pos == len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *exprParser) parseSum() (expr, error) {
+	x, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		y, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op, x, y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseProduct() (expr, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op, x, y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	switch c := p.peek(); {
+	case c == '-':
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negExpr{x}, nil
+	case c == '(':
+		p.pos++
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, ErrExpression
+		}
+		p.pos++
+		return x, nil
+	case c >= '0' && c <= '9' || c == '.':
+		return p.parseNumber()
+	}
+
+	name, err := p.parseName()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != '(' {
+		ref := p.fieldRef(name)
+		p.refs = append(p.refs, ref)
+		return fieldExpr(ref), nil
+	}
+	p.pos++
+
+	if n, ok := mathFuncs[name]; ok {
+		call := callExpr{fn: name}
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				if p.peek() != ',' {
+					return nil, ErrExpression
+				}
+				p.pos++
+			}
+			arg, err := p.parseSum()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+		}
+		if p.peek() != ')' {
+			return nil, ErrExpression
+		}
+		p.pos++
+		return call, nil
+	}
+
+	if !storage.KnownReducer(name) {
+		return nil, ErrExpression
+	}
+	field, err := p.parseName()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != ')' {
+		return nil, ErrExpression
+	}
+	p.pos++
+	ref := fieldRef{field, name}
+	p.refs = append(p.refs, ref)
+	return fieldExpr(ref), nil
+}
+
+func (p *exprParser) parseNumber() (expr, error) {
+	start := p.pos
+	for p.pos < len(p.src) && strings.IndexByte("0123456789.eE", p.src[p.pos]) >= 0 {
+		if (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') && p.pos+1 < len(p.src) && (p.src[p.pos+1] == '-' || p.src[p.pos+1] == '+') {
+			p.pos++
+		}
+		p.pos++
+	}
+	v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+	if err != nil {
+		return nil, ErrExpression
+	}
+	return numberExpr(v), nil
+}
+
+// parseName parses the name of a field, a function or a reducer. Names of
+// fields with other characters are quoted like 'bid-price'.
+func (p *exprParser) parseName() (string, error) {
+	if p.peek() == '\'' {
+		end := strings.IndexByte(p.src[p.pos+1:], '\'')
+		if end <= 0 {
+			return "", ErrExpression
+		}
+		name := p.src[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return name, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.src) && isNameChar(p.src[p.pos]) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", ErrExpression
+	}
+	return p.src[start:p.pos], nil
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c == '.' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// windowFuncs are the window functions of a query.
+var windowFuncs = map[string]storage.WindowFunc{
+	"moving_average":          storage.MovingAverage,
+	"ema":                     storage.EMA,
+	"derivative":              storage.Derivative,
+	"non_negative_derivative": storage.NonNegativeDerivative,
+	"difference":              storage.Difference,
+	"cumulative_sum":          storage.CumulativeSum,
+	"rate":                    storage.Rate,
+}
+
+// parseWindow parses a window like "moving_average(close, 20)" or
+// "derivative(close, 1h)": a function, a field of the query, and the
+// number of buckets, the weight or the unit of time of the function.
+func parseWindow(name, src string) (storage.Window, error) {
+	w := storage.Window{Name: name}
+	p := &exprParser{src: src}
+	fn, err := p.parseName()
+	if err != nil {
+		return w, ErrWindow
+	}
+	var ok bool
+	if w.Func, ok = windowFuncs[fn]; !ok || p.peek() != '(' {
+		return w, ErrWindow
+	}
+	p.pos++
+	if w.Field, err = p.parseName(); err != nil {
+		return w, ErrWindow
+	}
+
+	var arg string
+	if p.peek() == ',' {
+		end := strings.IndexByte(p.src[p.pos:], ')')
+		if end < 0 {
+			return w, ErrWindow
+		}
+		arg = strings.TrimSpace(p.src[p.pos+1 : p.pos+end])
+		p.pos += end
+	}
+	if p.peek() != ')' {
+		return w, ErrWindow
+	}
+	p.pos++
+	if p.peek() != 0 {
+		return w, ErrWindow
+	}
+
+	switch w.Func {
+	case storage.MovingAverage:
+		w.N, err = strconv.Atoi(arg)
+	case storage.EMA:
+		w.Alpha, err = strconv.ParseFloat(arg, 64)
+	case storage.Derivative, storage.NonNegativeDerivative, storage.Rate:
+		if arg != "" {
+			w.Per, err = time.ParseDuration(arg)
+		}
+	default:
+		if arg != "" {
+			return w, ErrWindow
+		}
+	}
+	if err != nil {
+		return w, ErrWindow
+	}
+	return w, nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"github.com/vimrus/tickdb/storage"
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseExpr(t *testing.T) {
+	values := map[fieldRef]float64{
+		{"close", "last"}:     4,
+		{"high", "max"}:       10,
+		{"low", "min"}:        2,
+		{"volume", "sum"}:     300,
+		{"bid-price", "last"}: 1.5,
+	}
+	lookup := func(ref fieldRef) (float64, bool) {
+		v, ok := values[ref]
+		return v, ok
+	}
+	// A field alone is reduced by its reducer, which is sum for volume.
+	ref := func(field string) fieldRef {
+		if field == "volume" {
+			return fieldRef{field, "sum"}
+		}
+		return fieldRef{field, "last"}
+	}
+
+	// nan stands for an expression left out for a missing field.
+	nan := math.NaN()
+	tests := []struct {
+		src  string
+		want float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"8 / 4 / 2", 1},
+		{"2 * 3 + 4 * 5", 26},
+		{"-2 * 3", -6},
+		{"--2", 2},
+		{"2 - -3", 5},
+		{"-(1 + 2)", -3},
+		{"1.5e2 + 2e-1", 150.2},
+		{".5", 0.5},
+		{"(max(high) - min(low)) / close", 2},
+		{"volume / 100", 3},
+		{"sum(volume) - volume", 0},
+		{"'bid-price' * 2", 3},
+		{"last('bid-price')", 1.5},
+		{"pow(2, 10)", 1024},
+		{"pow(close, 1 + 1)", 16},
+		{"sqrt(16) + abs(-2) + log(1)", 6},
+		{"missing", nan},
+		{"close + missing", nan},
+		{"missing * 0", nan},
+		{"-missing", nan},
+		{"abs(missing)", nan},
+		{"pow(close, missing)", nan},
+		{"max(close)", nan},
+	}
+	for _, test := range tests {
+		e, _, err := parseExpr(test.src, ref)
+		if err != nil {
+			t.Fatalf("%s: %v", test.src, err)
+		}
+		v, ok := e.eval(lookup)
+		if math.IsNaN(test.want) && ok || !math.IsNaN(test.want) && (!ok || math.Abs(v-test.want) > 1e-9) {
+			t.Fatalf("%s: expected %v, got %v (%v)", test.src, test.want, v, ok)
+		}
+	}
+
+	_, refs, err := parseExpr("(max(high) - min(low)) / close + 'bid-price'", ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []fieldRef{{"high", "max"}, {"low", "min"}, {"close", "last"}, {"bid-price", "last"}}
+	if !reflect.DeepEqual(refs, want) {
+		t.Fatalf("expected %v, got %v", want, refs)
+	}
+
+	invalid := []string{
+		"",
+		"1 +",
+		"* 2",
+		"(1 + 2",
+		"1 + 2)",
+		"1 2",
+		"1..2",
+		"pow(2)",
+		"pow(2, 3, 4)",
+		"abs()",
+		"abs(1, 2)",
+		"total(close)",
+		"max(close",
+		"max(1 + close)",
+		"'bid-price",
+		"''",
+		"close ^ 2",
+	}
+	for _, src := range invalid {
+		if _, _, err := parseExpr(src, ref); err != ErrExpression {
+			t.Fatalf("%q: expected ErrExpression, got %v", src, err)
+		}
+	}
+}
+
+func TestExecQueryExpressions(t *testing.T) {
+	db, err := storage.Open(filepath.Join(t.TempDir(), "expressions"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Two prices every hour, the volume in every hour but the second one.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC)
+	for h := 0; h < 4; h++ {
+		ts := base.Add(time.Duration(h) * time.Hour)
+		if err := db.Put(ts.UnixNano(), map[string]float64{"price": float64(10 + h)}); err != nil {
+			t.Fatal(err)
+		}
+		value := map[string]float64{"price": float64(12 + 2*h)}
+		if h != 1 {
+			value["volume"] = float64(100 * (h + 1))
+		}
+		if err := db.Put(ts.Add(30*time.Minute).UnixNano(), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// nan stands for a null field.
+	nan := math.NaN()
+	tests := []struct {
+		query Query
+		want  []map[string]float64
+	}{
+		{
+			Query{
+				Fields:      []byte(`{"price": ["min", "max"]}`),
+				Expressions: map[string]string{"spread": "max(price) - min(price)"},
+			},
+			[]map[string]float64{
+				{"price.min": 10, "price.max": 12, "spread": 2},
+				{"price.min": 11, "price.max": 14, "spread": 3},
+				{"price.min": 12, "price.max": 16, "spread": 4},
+				{"price.min": 13, "price.max": 18, "spread": 5},
+			},
+		},
+		{
+			Query{
+				Fields:      []byte(`"*"`),
+				Expressions: map[string]string{"turnover": "price * volume", "range": "max(price) - first(price)"},
+			},
+			[]map[string]float64{
+				{"price": 12, "volume": 100, "turnover": 1200, "range": 2},
+				{"price": 14, "volume": nan, "turnover": nan, "range": 3},
+				{"price": 16, "volume": 300, "turnover": 4800, "range": 4},
+				{"price": 18, "volume": 400, "turnover": 7200, "range": 5},
+			},
+		},
+		{
+			Query{
+				Fields:      []byte(`{"price": "min,max", "volume": "sum"}`),
+				Expressions: map[string]string{"vwap": "volume / count(volume)", "mid": "(price.min + price.max) / 2"},
+			},
+			[]map[string]float64{
+				{"price.min": 10, "price.max": 12, "volume": 100, "vwap": 100, "mid": 11},
+				{"price.min": 11, "price.max": 14, "volume": nan, "vwap": nan, "mid": 12.5},
+				{"price.min": 12, "price.max": 16, "volume": 300, "vwap": 300, "mid": 14},
+				{"price.min": 13, "price.max": 18, "volume": 400, "vwap": 400, "mid": 15.5},
+			},
+		},
+		{
+			Query{
+				Fields:      []byte(`{"*": "count"}`),
+				Expressions: map[string]string{"trades": "price", "total": "price + volume"},
+			},
+			[]map[string]float64{
+				{"price": 2, "volume": 1, "trades": 2, "total": 3},
+				{"price": 2, "volume": nan, "trades": 2, "total": nan},
+				{"price": 2, "volume": 1, "trades": 2, "total": 3},
+				{"price": 2, "volume": 1, "trades": 2, "total": 3},
+			},
+		},
+		{
+			Query{
+				From:        "2016-08-28T01:00:00Z",
+				Fields:      []byte(`{"price": "last"}`),
+				Expressions: map[string]string{"dev": "price - avg(price)"},
+				Windows:     map[string]string{"ma": "moving_average(price, 2)"},
+			},
+			[]map[string]float64{
+				{"price": 14, "ma": 13, "dev": 1.5},
+				{"price": 16, "ma": 15, "dev": 2},
+				{"price": 18, "ma": 17, "dev": 2.5},
+			},
+		},
+		{
+			Query{
+				Fields:      []byte(`{"price": ["min", "max"]}`),
+				Expressions: map[string]string{"spread": "max(price) - min(price)"},
+				Windows:     map[string]string{"change": "difference(price.max)", "acceleration": "difference(change)"},
+			},
+			[]map[string]float64{
+				{"price.min": 10, "price.max": 12, "spread": 2, "change": nan, "acceleration": nan},
+				{"price.min": 11, "price.max": 14, "spread": 3, "change": 2, "acceleration": nan},
+				{"price.min": 12, "price.max": 16, "spread": 4, "change": 2, "acceleration": 0},
+				{"price.min": 13, "price.max": 18, "spread": 5, "change": 2, "acceleration": 0},
+			},
+		},
+	}
+	for _, test := range tests {
+		query := test.query
+		if query.From == "" {
+			query.From = "2016-08-28T00:00:00Z"
+		}
+		query.To, query.Group = "2016-08-28T04:00:00Z", "1h"
+		result, err := execQuery(db, query)
+		if err != nil {
+			t.Fatalf("%+v: %v", test.query, err)
+		}
+		checkQueryPoints(t, result.([]QueryPoint), test.want)
+	}
+}
+
+// checkQueryPoints checks the fields of the points of a query, NaN standing
+// for null.
+func checkQueryPoints(t *testing.T, points []QueryPoint, want []map[string]float64) {
+	t.Helper()
+	if len(points) != len(want) {
+		t.Fatalf("expected %d points, got %d", len(want), len(points))
+	}
+	for i, p := range points {
+		if len(p.Value) != len(want[i]) {
+			t.Fatalf("point %d: expected the fields %v, got %v", i, want[i], p.Value)
+		}
+		for name, w := range want[i] {
+			v, ok := p.Value[name]
+			if !ok {
+				t.Fatalf("point %d: expected %s, got %v", i, name, p.Value)
+			}
+			if math.IsNaN(w) && v != nil || !math.IsNaN(w) && (v == nil || math.Abs(*v-w) > 1e-9) {
+				t.Fatalf("point %d: expected %s %v, got %v", i, name, w, v)
+			}
+		}
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		src  string
+		want storage.Window
+	}{
+		{"moving_average(close, 20)", storage.Window{Func: storage.MovingAverage, Field: "close", N: 20}},
+		{"ema(close,0.5)", storage.Window{Func: storage.EMA, Field: "close", Alpha: 0.5}},
+		{"derivative(close, 1h)", storage.Window{Func: storage.Derivative, Field: "close", Per: time.Hour}},
+		{"non_negative_derivative(close)", storage.Window{Func: storage.NonNegativeDerivative, Field: "close"}},
+		{"rate(requests, 1m)", storage.Window{Func: storage.Rate, Field: "requests", Per: time.Minute}},
+		{" difference( 'bid-price' ) ", storage.Window{Func: storage.Difference, Field: "bid-price"}},
+		{"cumulative_sum(price.max)", storage.Window{Func: storage.CumulativeSum, Field: "price.max"}},
+	}
+	for _, test := range tests {
+		w, err := parseWindow("w", test.src)
+		if err != nil {
+			t.Fatalf("%s: %v", test.src, err)
+		}
+		test.want.Name = "w"
+		if w != test.want {
+			t.Fatalf("%s: expected %+v, got %+v", test.src, test.want, w)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"close",
+		"median(close)",
+		"moving_average(close)",
+		"moving_average(close, x)",
+		"ema(close, )",
+		"derivative(close, 1)",
+		"difference(close, 1)",
+		"difference()",
+		"difference(close",
+		"difference(close) + 1",
+	}
+	for _, src := range invalid {
+		if _, err := parseWindow("w", src); err != ErrWindow {
+			t.Fatalf("%q: expected ErrWindow, got %v", src, err)
+		}
+	}
+}
+
+func TestParseWindows(t *testing.T) {
+	reducer := map[string]string{"price": "min,max", "close": "last"}
+	reducers := map[string]string{"price": "min,max", "close": "last,avg"}
+
+	// A window of another window is computed after it, the fields are the
+	// keys queried with reducers.
+	windows := map[string]string{
+		"c":  "difference(b)",
+		"b":  "difference(a)",
+		"a":  "moving_average(close, 2)",
+		"ma": "moving_average(price.max, 3)",
+	}
+	got, err := parseWindows(windows, reducer, reducers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names, fields []string
+	for _, w := range got {
+		names, fields = append(names, w.Name), append(fields, w.Field)
+	}
+	if want := []string{"a", "b", "c", "ma"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected the windows %v, got %v", want, names)
+	}
+	if want := []string{"close.last", "a", "b", "price.max"}; !reflect.DeepEqual(fields, want) {
+		t.Fatalf("expected the fields %v, got %v", want, fields)
+	}
+
+	invalid := []map[string]string{
+		{"a": "difference(a)"},
+		{"a": "difference(b)", "b": "difference(a)"},
+		{"a": "difference(b)", "b": "difference(c)", "c": "difference(a)"},
+		{"a": "difference(close)", "b": "median(a)"},
+	}
+	for _, windows := range invalid {
+		if _, err := parseWindows(windows, reducer, reducers); err != ErrWindow {
+			t.Fatalf("%v: expected ErrWindow, got %v", windows, err)
+		}
+	}
+}
@@ -50,6 +50,10 @@ func deleteDB(args []string, w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func cacheInfo(args []string, w http.ResponseWriter, req *http.Request) {
+	render(200, w, dbOptions.Cache.Stats())
+}
+
 func listDatabases(args []string, w http.ResponseWriter, req *http.Request) {
 	render(200, w, dblist(*dbRoot))
 }
@@ -95,6 +99,25 @@ func query(args []string, w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func candles(args []string, w http.ResponseWriter, req *http.Request) {
+	path := dbPath(args[0])
+
+	result, bodyErr := ioutil.ReadAll(req.Body)
+	if bodyErr != nil {
+		emitError(500, w, "Server Error", bodyErr.Error())
+	} else {
+		var query CandlesQuery
+		json.Unmarshal(result, &query)
+
+		data, err := dbcandles(path, query)
+		if err != nil {
+			emitError(500, w, "Server Error", err.Error())
+		} else {
+			render(200, w, data)
+		}
+	}
+}
+
 func getDocument(args []string, w http.ResponseWriter, req *http.Request) {
 	path := dbPath(args[0])
 	index := args[1]
@@ -123,6 +146,21 @@ func removeIndex(args []string, w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func compactIndex(args []string, w http.ResponseWriter, req *http.Request) {
+	path := dbPath(args[0])
+	index := args[1]
+	before, after, err := indexcompact(path, index)
+	if err != nil {
+		emitError(500, w, "Server Error", err.Error())
+	} else {
+		render(200, w, map[string]interface{}{
+			"index":  index,
+			"before": before,
+			"after":  after,
+		})
+	}
+}
+
 func removeDocuments(args []string, w http.ResponseWriter, req *http.Request) {
 	path := dbPath(args[0])
 	index := args[1]
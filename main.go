@@ -1,17 +1,27 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/vimrus/tickdb/storage"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"regexp"
+	"syscall"
 	"time"
 )
 
 var dbRoot = flag.String("root", "db", "Root directory of database files.")
+var walSync = flag.String("wal-sync", "always", "When to fsync the write-ahead log: always, interval or never.")
+var walSyncInterval = flag.Duration("wal-sync-interval", 100*time.Millisecond, "How often the write-ahead log is fsynced with -wal-sync=interval.")
+var cacheSize = flag.Int64("cache-size", 256<<20, "Bytes of index nodes kept in memory for queries, shared by all indexes.")
+var lockTimeout = flag.Duration("lock-timeout", time.Second, "How long to wait for the lock of a file held by another process.")
+var zone = flag.String("zone", "UTC", "Time zone that new indexes bucket days, months and years in.")
 
 type routeHandler func(parts []string, w http.ResponseWriter, req *http.Request)
 
@@ -25,11 +35,15 @@ var routing = []router{
 	router{"GET", "^/$", serverInfo},
 
 	router{"GET", "^/_all_dbs$", listDatabases},
+	router{"GET", "^/_checkpoint$", checkpointInfo},
+	router{"GET", "^/_cache$", cacheInfo},
 	router{"GET", "^/([-%+()$_a-zA-Z-1-9]+)/?$", dbInfo},
 	router{"PUT", "^/([-%+()$_a-zA-Z0-9]+)/?$", createDB},
 	router{"DELETE", "^/([-%+()$_a-zA-Z0-9]+)/_all$", deleteDB},
 
 	router{"POST", "^/([-%+()$_a-zA-Z0-9]+)/_query$", query},
+	router{"POST", "^/([-%+()$_a-zA-Z0-9]+)/_candles$", candles},
+	router{"POST", "^/([-%+()$_a-zA-Z0-9]+)/([^/]+)/_compact$", compactIndex},
 	router{"POST", "^/([-%+()$_a-zA-Z0-9]+)/?$", putDocuments},
 	router{"GET", "^/([-%+()$_a-zA-Z0-9]+)/([^/]+)/([^/]+)$", getDocument},
 	router{"DELETE", "^/([-%+()$_a-zA-Z0-9]+)/([^/]+)/_all$", removeIndex},
@@ -82,6 +96,24 @@ func handler(w http.ResponseWriter, req *http.Request) {
 
 func main() {
 	addr := flag.String("addr", ":9527", "Address to listen on")
+	flag.Parse()
+
+	policy, err := parseSyncPolicy(*walSync)
+	if err != nil {
+		log.Fatalf("Error parsing -wal-sync: %v", err)
+	}
+	loc, err := time.LoadLocation(*zone)
+	if err != nil {
+		log.Fatalf("Error parsing -zone: %v", err)
+	}
+	dbOptions = &storage.Options{
+		SyncPolicy:   policy,
+		SyncInterval: *walSyncInterval,
+		Timeout:      *lockTimeout,
+		Cache:        storage.NewCache(*cacheSize),
+		Location:     loc,
+	}
+
 	s := &http.Server{
 		Addr:        *addr,
 		Handler:     http.HandlerFunc(handler),
@@ -94,5 +126,22 @@ func main() {
 	}
 	log.Printf("Listening on %s", *addr)
 
-	s.Serve(ln)
+	go checkpoints.run(*flushInterval)
+
+	// Stop accepting requests on SIGINT/SIGTERM, and flush before exit.
+	stopped := make(chan struct{})
+	go func() {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigc
+		log.Printf("Received %v, shutting down", sig)
+		s.Shutdown(context.Background())
+		close(stopped)
+	}()
+
+	if err := s.Serve(ln); err != http.ErrServerClosed {
+		log.Fatalf("Error serving: %v", err)
+	}
+	<-stopped
+	shutdown()
 }
@@ -1,61 +1,268 @@
 package main
 
 import (
+	"encoding/json"
 	"github.com/dustin/seriesly/timelib"
 	"github.com/vimrus/tickdb/storage"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Field struct {
-	Reducer string `json:"reducer"`
+	Reducer    string  `json:"reducer"`
+	Percentile float64 `json:"percentile"`
 }
 type Query struct {
-	Index  string           `json:"index"`
-	From   string           `json:"from"`
-	To     string           `json:"to"`
-	Group  string           `json:"group"`
-	Fields map[string]Field `json:"fields"`
-}
-
-func parseGroup(group string) (int, uint16) {
-	var count int
-	var level uint16
-
-	for i, value := range []byte(group) {
-		// number is between 48~57
-		if value < 48 || value > 57 {
-			count, _ = strconv.Atoi(string([]byte(group)[0:i]))
-			unit := string([]byte(group)[i:])
-			switch unit {
-			case "second":
-				fallthrough
-			case "seconds":
-				level = storage.LevelMinute
-			case "minute":
-				fallthrough
-			case "minutes":
-				level = storage.LevelMinute
-			case "hour":
-				fallthrough
-			case "hours":
-				level = storage.LevelHour
-			case "day":
-				fallthrough
-			case "days":
-				level = storage.LevelDay
-			case "month":
-				fallthrough
-			case "months":
-				level = storage.LevelMonth
-			case "year":
-				fallthrough
-			case "years":
-				level = storage.LevelYear
+	Index     string          `json:"index"`
+	From      string          `json:"from"`
+	To        string          `json:"to"`
+	Group     string          `json:"group"`
+	Zone      string          `json:"zone"`
+	Offset    string          `json:"offset"`
+	WeekStart string          `json:"week_start"`
+	Fill      interface{}     `json:"fill"`
+	Reducer   string          `json:"reducer"`
+	Fields    json.RawMessage `json:"fields"`
+	Where     *storage.Filter `json:"where"`
+
+	// Expressions are computed fields, by their names.
+	Expressions map[string]string `json:"expressions"`
+
+	// Windows are functions over the buckets of fields, by their names.
+	Windows map[string]string `json:"windows"`
+
+	// Order is "asc" or "desc", Skip and Limit are the numbers of buckets
+	// skipped and returned at most, in that order. "offset" is taken by the
+	// offset of the buckets.
+	Order string `json:"order"`
+	Skip  int    `json:"skip"`
+	Limit int    `json:"limit"`
+}
+
+// QueryPoint is a bucket of the result of a query, the fields missing in
+// the bucket are null.
+type QueryPoint struct {
+	Timestamp int64
+	Value     map[string]*float64
+}
+type CandlesQuery struct {
+	Index     string `json:"index"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Interval  string `json:"interval"`
+	Zone      string `json:"zone"`
+	Offset    string `json:"offset"`
+	WeekStart string `json:"week_start"`
+	Price     string `json:"price"`
+	Volume    string `json:"volume"`
+	Fill      bool   `json:"fill"`
+}
+
+// groupUnits are the units of a group and their levels.
+var groupUnits = map[string]uint16{
+	"ns":           storage.LevelNSecond,
+	"nanosecond":   storage.LevelNSecond,
+	"nanoseconds":  storage.LevelNSecond,
+	"us":           storage.LevelUSecond,
+	"µs":           storage.LevelUSecond,
+	"microsecond":  storage.LevelUSecond,
+	"microseconds": storage.LevelUSecond,
+	"ms":           storage.LevelMSecond,
+	"millisecond":  storage.LevelMSecond,
+	"milliseconds": storage.LevelMSecond,
+	"s":            storage.LevelSecond,
+	"second":       storage.LevelSecond,
+	"seconds":      storage.LevelSecond,
+	"m":            storage.LevelMinute,
+	"minute":       storage.LevelMinute,
+	"minutes":      storage.LevelMinute,
+	"h":            storage.LevelHour,
+	"hour":         storage.LevelHour,
+	"hours":        storage.LevelHour,
+	"d":            storage.LevelDay,
+	"day":          storage.LevelDay,
+	"days":         storage.LevelDay,
+	"w":            storage.LevelWeek,
+	"week":         storage.LevelWeek,
+	"weeks":        storage.LevelWeek,
+	"month":        storage.LevelMonth,
+	"months":       storage.LevelMonth,
+	"q":            storage.LevelQuarter,
+	"quarter":      storage.LevelQuarter,
+	"quarters":     storage.LevelQuarter,
+	"y":            storage.LevelYear,
+	"year":         storage.LevelYear,
+	"years":        storage.LevelYear,
+}
+
+// weekdays are the days a week can start on, numbered as in ISO 8601.
+var weekdays = map[string]int{
+	"monday":    1,
+	"tuesday":   2,
+	"wednesday": 3,
+	"thursday":  4,
+	"friday":    5,
+	"saturday":  6,
+	"sunday":    7,
+}
+
+// fillPolicies are the fill policies of a query, besides a number.
+var fillPolicies = map[string]storage.FillPolicy{
+	"none":     storage.FillNone,
+	"null":     storage.FillNull,
+	"previous": storage.FillPrevious,
+	"linear":   storage.FillLinear,
+}
+
+// parseFill parses the fill of a query, a policy name or a number to fill
+// with.
+func parseFill(fill interface{}) (*storage.QueryOptions, error) {
+	options := &storage.QueryOptions{}
+	switch f := fill.(type) {
+	case nil:
+	case float64:
+		options.Fill = storage.FillConstant
+		options.FillValue = f
+	case string:
+		policy, ok := fillPolicies[f]
+		if !ok {
+			return nil, ErrFill
+		}
+		options.Fill = policy
+	default:
+		return nil, ErrFill
+	}
+	return options, nil
+}
+
+// defaultReducer reduces the fields of a query which are named without a
+// reducer.
+const defaultReducer = "last"
+
+// parseFields parses the fields of a query into their reducers. The fields
+// are "*" for all of them, a list of names, or an object of names and their
+// reducers: a reducer, a list of reducers or a Field. The fields without a
+// reducer are reduced by reducer.
+func parseFields(fields json.RawMessage, reducer string) (map[string]string, error) {
+	if reducer == "" {
+		reducer = defaultReducer
+	}
+	if !knownReducers(reducer) {
+		return nil, ErrFields
+	}
+	reducers := make(map[string]string)
+	if len(fields) == 0 {
+		return reducers, nil
+	}
+
+	var all string
+	if err := json.Unmarshal(fields, &all); err == nil {
+		if all != storage.Wildcard {
+			return nil, ErrFields
+		}
+		reducers[storage.Wildcard] = reducer
+		return reducers, nil
+	}
+	var names []string
+	if err := json.Unmarshal(fields, &names); err == nil {
+		for _, field := range names {
+			reducers[field] = reducer
+		}
+		return reducers, nil
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(fields, &object); err != nil {
+		return nil, ErrFields
+	}
+	for field, raw := range object {
+		r, err := parseFieldReducer(raw)
+		if err != nil {
+			return nil, err
+		}
+		if r == "" {
+			r = reducer
+		} else if !knownReducers(r) {
+			return nil, ErrFields
+		}
+		reducers[field] = r
+	}
+	return reducers, nil
+}
+
+// knownReducers returns whether every reducer of a field, separated by
+// commas, is known.
+func knownReducers(reducers string) bool {
+	for _, r := range strings.Split(reducers, ",") {
+		if !storage.KnownReducer(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseFieldReducer parses the reducers of a field, several of them are
+// separated by commas.
+func parseFieldReducer(raw json.RawMessage) (string, error) {
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		return name, nil
+	}
+	var names []string
+	if err := json.Unmarshal(raw, &names); err == nil {
+		for _, r := range names {
+			if r == "" || strings.Contains(r, ",") {
+				return "", ErrFields
 			}
-			break
 		}
+		return strings.Join(names, ","), nil
+	}
+	var field Field
+	if err := json.Unmarshal(raw, &field); err != nil {
+		return "", ErrFields
 	}
-	return count, level
+	if field.Reducer == "percentile" || field.Reducer == "" && field.Percentile != 0 {
+		if !(field.Percentile >= 0 && field.Percentile <= 100) {
+			return "", ErrFields
+		}
+		return "p" + strconv.FormatFloat(field.Percentile, 'f', -1, 64), nil
+	}
+	return field.Reducer, nil
+}
+
+// queryPoints returns the points of a query with every field of the result
+// in each of them, null where it is missing.
+func queryPoints(points []*storage.Point) []QueryPoint {
+	fields := make(map[string]bool)
+	for _, p := range points {
+		for field := range p.Value {
+			fields[field] = true
+		}
+	}
+	result := make([]QueryPoint, len(points))
+	for i, p := range points {
+		value := make(map[string]*float64, len(fields))
+		for field := range fields {
+			if v, ok := p.Value[field]; ok {
+				value[field] = &v
+			} else {
+				value[field] = nil
+			}
+		}
+		result[i] = QueryPoint{Timestamp: p.Timestamp, Value: value}
+	}
+	return result
+}
+
+// parseGroup parses a group like "5minutes" or "100ms" into the number of
+// units and the level of the unit, false if the unit is unknown.
+func parseGroup(group string) (int, uint16, bool) {
+	unit := strings.TrimLeft(group, "0123456789")
+	count, _ := strconv.Atoi(group[:len(group)-len(unit)])
+	level, ok := groupUnits[unit]
+	return count, level, ok
 }
 
 /*
@@ -64,35 +271,340 @@ func parseGroup(group string) (int, uint16) {
 		"from":"2016-05-31T08:00:00Z",
 		"to":"2016-05-31T18:00:59Z",
 		"group": "5minutes",
+		"offset": "2m",
+		"week_start": "sunday",
+		"zone": "America/New_York",
+		"fill": "previous",
+		"reducer": "avg",
 		"fields":{
 			"open": {"reducer":"first"},
-			"close": {"reducer":"last"},
-		}
+			"close": "last",
+			"price": ["min", "max", "avg"],
+			"latency": {"reducer":"percentile", "percentile": 99.9},
+			"*": "count",
+		},
+		"expressions": {
+			"range": "(max(high) - min(low)) / close",
+			"mid": "(bid + ask) / 2"
+		},
+		"windows": {
+			"close_ma": "moving_average(close, 20)",
+			"close_change": "derivative(close, 1h)"
+		},
+		"order": "desc",
+		"limit": 100,
+		"where": {"and": [
+			{"field": "volume", "op": ">", "value": 1000},
+			{"not": {"exists": "cancelled"}}
+		]}
 	}'
 */
 func execQuery(db *storage.DB, query Query) (interface{}, error) {
-	//from
-	from, fromErr := timelib.ParseTime(query.From)
-	if fromErr != nil {
-		return nil, fromErr
+	fromTS, toTS, err := parseRange(query.From, query.To)
+	if err != nil {
+		return nil, err
+	}
+	group, err := parseGroupOptions(query.Group, query.Offset, query.WeekStart, query.Zone)
+	if err != nil {
+		return nil, err
+	}
+	options, err := parseFill(query.Fill)
+	if err != nil {
+		return nil, err
+	}
+	options.Filter = query.Where
+	switch query.Order {
+	case "", "asc":
+	case "desc":
+		options.Desc = true
+	default:
+		return nil, ErrOrder
+	}
+	options.Offset, options.Limit = query.Skip, query.Limit
+
+	reducer, err := parseFields(query.Fields, query.Reducer)
+	if err != nil {
+		return nil, err
+	}
+	exprs, refs, err := parseExpressions(query.Expressions, reducer, query.Reducer)
+	if err != nil {
+		return nil, err
+	}
+	reducers := withRefs(reducer, refs)
+	options.Windows, err = parseWindows(query.Windows, reducer, reducers)
+	if err != nil {
+		return nil, err
+	}
+	points, err := db.Query(fromTS, toTS, group, reducers, options)
+	if err != nil {
+		return nil, err
+	}
+	if len(exprs) > 0 {
+		evalExpressions(points, exprs, reducer, reducers, options.Windows)
+	}
+	return queryPoints(points), nil
+}
+
+// parseWindows parses the windows of a query, in the order they are
+// computed: a window of the field of another window after the other one.
+// The fields of the windows are the ones of the query with reducer, which is
+// queried with reducers.
+func parseWindows(windows map[string]string, reducer map[string]string, reducers map[string]string) ([]storage.Window, error) {
+	names := make([]string, 0, len(windows))
+	for name := range windows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pending := make(map[string]storage.Window, len(windows))
+	for _, name := range names {
+		w, err := parseWindow(name, windows[name])
+		if err != nil {
+			return nil, err
+		}
+		if w.Field == name {
+			return nil, ErrWindow
+		}
+		pending[name] = w
+	}
+
+	var result []storage.Window
+	for len(pending) > 0 {
+		n := len(result)
+		for _, name := range names {
+			w, ok := pending[name]
+			if !ok {
+				continue
+			}
+			if _, waits := pending[w.Field]; waits {
+				continue
+			}
+			if _, window := windows[w.Field]; !window {
+				w.Field = queriedKey(w.Field, reducer, reducers)
+			}
+			result = append(result, w)
+			delete(pending, name)
+		}
+		if len(result) == n {
+			return nil, ErrWindow
+		}
+	}
+	return result, nil
+}
+
+// queriedKey returns the field of the points queried with reducers which is
+// the field key of the points of the query with reducer.
+func queriedKey(key string, reducer map[string]string, reducers map[string]string) string {
+	if list := fieldReducers(reducer, key); len(list) == 1 {
+		return reducedKey(key, fieldReducers(reducers, key), list[0])
+	}
+	if i := strings.LastIndexByte(key, '.'); i >= 0 {
+		field, r := key[:i], key[i+1:]
+		if list := fieldReducers(reducer, field); len(list) > 1 && containsReducer(list, r) {
+			return reducedKey(field, fieldReducers(reducers, field), r)
+		}
+	}
+	return key
+}
+
+// parseExpressions parses the expressions of a query and returns the fields
+// they need. A field alone is reduced by its reducer if the query has a
+// single one for it, named or by the wildcard, otherwise by reducer. A key of a field with several
+// reducers, like "price.max", is the field reduced by that one.
+func parseExpressions(expressions map[string]string, fields map[string]string, reducer string) (map[string]expr, []fieldRef, error) {
+	if reducer == "" {
+		reducer = defaultReducer
+	}
+	ref := func(name string) fieldRef {
+		if list := fieldReducers(fields, name); len(list) == 1 && storage.KnownReducer(list[0]) {
+			return fieldRef{name, list[0]}
+		}
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			field, r := name[:i], name[i+1:]
+			if list := fieldReducers(fields, field); len(list) > 1 && containsReducer(list, r) {
+				return fieldRef{field, r}
+			}
+		}
+		return fieldRef{name, reducer}
+	}
+
+	exprs := make(map[string]expr, len(expressions))
+	var refs []fieldRef
+	for name, src := range expressions {
+		e, r, err := parseExpr(src, ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		exprs[name] = e
+		refs = append(refs, r...)
+	}
+	return exprs, refs, nil
+}
+
+// withRefs returns the reducers of the fields of a query together with the
+// ones its expressions need.
+func withRefs(reducer map[string]string, refs []fieldRef) map[string]string {
+	if len(refs) == 0 {
+		return reducer
+	}
+	reducers := make(map[string]string, len(reducer))
+	for field, r := range reducer {
+		reducers[field] = r
+	}
+	for _, ref := range refs {
+		list := fieldReducers(reducers, ref.field)
+		if !containsReducer(list, ref.reducer) {
+			list = append(list, ref.reducer)
+		}
+		reducers[ref.field] = strings.Join(list, ",")
+	}
+	return reducers
+}
+
+// fieldReducers returns the reducers of a field, the ones of the wildcard
+// if it is not named.
+func fieldReducers(reducer map[string]string, field string) []string {
+	r, ok := reducer[field]
+	if !ok {
+		if r, ok = reducer[storage.Wildcard]; !ok {
+			return nil
+		}
+	}
+	return strings.Split(r, ",")
+}
+
+func containsReducer(list []string, reducer string) bool {
+	for _, r := range list {
+		if r == reducer {
+			return true
+		}
 	}
-	fromTS := from.UnixNano()
+	return false
+}
 
-	//to
-	to, toErr := timelib.ParseTime(query.To)
-	if toErr != nil {
-		return nil, toErr
+// reducedKey returns the field of a point which a field is reduced to by
+// reducer, being one of reducers. It is the field itself for a single
+// reducer, as for storage.DB.Query.
+func reducedKey(field string, reducers []string, reducer string) string {
+	if len(reducers) == 1 {
+		return field
 	}
-	toTS := to.UnixNano()
+	return field + "." + reducer
+}
 
-	//group
-	count, level := parseGroup(query.Group)
+// evalExpressions adds the expressions to the points, which were queried
+// with reducers and windows, and leaves the fields of reducer and the windows
+// only. An expression whose fields are missing, or whose value is not a
+// number, is left out.
+func evalExpressions(points []*storage.Point, exprs map[string]expr, reducer map[string]string, reducers map[string]string, windows []storage.Window) {
+	isWindow := make(map[string]bool, len(windows))
+	for _, w := range windows {
+		isWindow[w.Name] = true
+	}
+	for _, p := range points {
+		lookup := func(ref fieldRef) (float64, bool) {
+			v, ok := p.Value[reducedKey(ref.field, fieldReducers(reducers, ref.field), ref.reducer)]
+			return v, ok
+		}
+		values := make(map[string]float64, len(exprs))
+		for name, e := range exprs {
+			if v, ok := e.eval(lookup); ok && !math.IsNaN(v) && !math.IsInf(v, 0) {
+				values[name] = v
+			}
+		}
+
+		// Move the fields back to their keys of reducer, and drop the ones
+		// the expressions needed only.
+		for field, r := range reducers {
+			if field == storage.Wildcard || r == reducer[field] {
+				continue
+			}
+			list, wanted := strings.Split(r, ","), fieldReducers(reducer, field)
+			moved := make(map[string]float64, len(wanted))
+			for _, name := range list {
+				key := reducedKey(field, list, name)
+				if isWindow[key] {
+					continue
+				}
+				v, ok := p.Value[key]
+				delete(p.Value, key)
+				if ok && containsReducer(wanted, name) && !isWindow[reducedKey(field, wanted, name)] {
+					moved[reducedKey(field, wanted, name)] = v
+				}
+			}
+			for key, v := range moved {
+				p.Value[key] = v
+			}
+		}
+		for name, v := range values {
+			p.Value[name] = v
+		}
+	}
+}
+
+/*
+	candles := {
+		"index": "sample",
+		"from":"2016-05-31T08:00:00Z",
+		"to":"2016-05-31T18:00:59Z",
+		"interval": "5minutes",
+		"price": "price",
+		"volume": "volume",
+		"fill": true
+	}'
+*/
+func execCandles(db *storage.DB, query CandlesQuery) (interface{}, error) {
+	fromTS, toTS, err := parseRange(query.From, query.To)
+	if err != nil {
+		return nil, err
+	}
+	group, err := parseGroupOptions(query.Interval, query.Offset, query.WeekStart, query.Zone)
+	if err != nil {
+		return nil, err
+	}
+	return db.Candles(fromTS, toTS, group, query.Price, query.Volume, query.Fill)
+}
 
-	reducer := make(map[string]string)
+// parseRange parses the times of a query.
+func parseRange(from, to string) (int64, int64, error) {
+	fromTime, err := timelib.ParseTime(from)
+	if err != nil {
+		return 0, 0, err
+	}
+	toTime, err := timelib.ParseTime(to)
+	if err != nil {
+		return 0, 0, err
+	}
+	return fromTime.UnixNano(), toTime.UnixNano(), nil
+}
 
-	//fields
-	for field, opts := range query.Fields {
-		reducer[field] = opts.Reducer
+// parseGroupOptions parses the buckets of a query.
+func parseGroupOptions(groupName, offset, weekStart, zone string) (storage.Group, error) {
+	count, level, ok := parseGroup(groupName)
+	group := storage.Group{Level: level, Count: count}
+	if !ok {
+		return group, ErrGroup
+	}
+	if offset != "" {
+		d, err := time.ParseDuration(offset)
+		if err != nil {
+			return group, err
+		}
+		group.Offset = d
+	}
+	if weekStart != "" {
+		day, ok := weekdays[strings.ToLower(weekStart)]
+		if !ok {
+			return group, ErrWeekStart
+		}
+		group.WeekStart = day
+	}
+	if zone != "" {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return group, err
+		}
+		group.Location = loc
 	}
-	return db.Query(fromTS, toTS, level, count, reducer), nil
+	return group, nil
 }
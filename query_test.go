@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/vimrus/tickdb/storage"
+	"reflect"
+	"testing"
+)
+
+func TestParseFields(t *testing.T) {
+	tests := []struct {
+		fields  string
+		reducer string
+		want    map[string]string
+	}{
+		{``, "", map[string]string{}},
+		{`"*"`, "", map[string]string{storage.Wildcard: "last"}},
+		{`"*"`, "sum,max", map[string]string{storage.Wildcard: "sum,max"}},
+		{`["open", "close"]`, "avg", map[string]string{"open": "avg", "close": "avg"}},
+		{`{"open": {"reducer": "first"}, "close": "", "price": ["min", "max"]}`, "", map[string]string{"open": "first", "close": "last", "price": "min,max"}},
+		{`{"latency": {"reducer": "percentile", "percentile": 99.9}, "size": {"percentile": 50}}`, "", map[string]string{"latency": "p99.9", "size": "p50"}},
+	}
+	for _, test := range tests {
+		got, err := parseFields(json.RawMessage(test.fields), test.reducer)
+		if err != nil {
+			t.Fatalf("%s: %v", test.fields, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%s: expected %v, got %v", test.fields, test.want, got)
+		}
+	}
+
+	invalid := []struct {
+		fields  string
+		reducer string
+	}{
+		{`"price"`, ""},
+		{`"*"`, "average"},
+		{`["price"]`, "sum,"},
+		{`{"price": "median,mode"}`, ""},
+		{`{"price": ["sum", "total"]}`, ""},
+		{`{"price": {"reducer": "total"}}`, ""},
+		{`{"price": 1}`, ""},
+		{`{"price": {"reducer": "percentile", "percentile": 200}}`, ""},
+		{`{"price": {"percentile": -1}}`, ""},
+		{`{"price": "pNaN"}`, ""},
+	}
+	for _, test := range invalid {
+		if _, err := parseFields(json.RawMessage(test.fields), test.reducer); err != ErrFields {
+			t.Fatalf("%s %q: expected ErrFields, got %v", test.fields, test.reducer, err)
+		}
+	}
+}
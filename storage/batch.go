@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Batch collects points which are written together by Write.
+type Batch struct {
+	db     *DB
+	points []Point
+}
+
+// NewBatch returns an empty batch for the database.
+func (db *DB) NewBatch() *Batch {
+	return &Batch{db: db}
+}
+
+// Put adds a point to the batch, key is unixnano.
+func (b *Batch) Put(key int64, value map[string]float64) {
+	b.points = append(b.points, Point{Timestamp: key, Value: value})
+}
+
+// Len returns the number of points in the batch.
+func (b *Batch) Len() int {
+	return len(b.points)
+}
+
+// Reset empties the batch so it can be reused.
+func (b *Batch) Reset() {
+	b.points = b.points[:0]
+}
+
+// Write writes the points of the batch with PutBatch.
+func (b *Batch) Write() error {
+	return b.db.PutBatch(b.points)
+}
+
+// PutBatch inserts many points at once. They are logged as a single record,
+// inserted in time order so points sharing a leaf need only one descent, and
+// the aggregates are recomputed once for the whole batch. If a key occurs more
+// than once the last point wins, like with consecutive calls of Put.
+func (db *DB) PutBatch(points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	sorted := sortPoints(points)
+	if err := db.wal.batch(sorted); err != nil {
+		return err
+	}
+	return db.putBatch(sorted)
+}
+
+// sortPoints returns a copy of points in time order without duplicate keys.
+func sortPoints(points []Point) []Point {
+	sorted := make([]Point, len(points))
+	copy(sorted, points)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Timestamp < sorted[j].Timestamp
+	})
+
+	// Keep the last of the points with the same key.
+	n := 0
+	for i := range sorted {
+		if i+1 < len(sorted) && sorted[i+1].Timestamp == sorted[i].Timestamp {
+			continue
+		}
+		sorted[n] = sorted[i]
+		n++
+	}
+	return sorted[:n]
+}
+
+// putBatch inserts points which are sorted by sortPoints.
+func (db *DB) putBatch(points []Point) error {
+	c := db.Cursor()
+	for i := 0; i < len(points); {
+		tm := db.newTime(points[i].Timestamp)
+
+		// Move cursor to correct position.
+		c.stack = c.stack[:0]
+		if err := c.fix(&tm, db.root); err != nil {
+			return err
+		}
+
+		n := c.node()
+		if err := n.insert(&tm, points[i].Value); err != nil {
+			return err
+		}
+		i++
+		if !n.isLeaf {
+			continue
+		}
+
+		// The following points of the same leaf are inserted directly.
+		for ; i < len(points); i++ {
+			t := db.newTime(points[i].Timestamp)
+			if !n.holds(&tm, &t) {
+				break
+			}
+			if err := n.insertPoint(&t, points[i].Value); err != nil {
+				return err
+			}
+		}
+	}
+
+	db.root.reduce()
+	return nil
+}
+
+// batch appends the insertion of points sorted by sortPoints.
+func (w *wal) batch(points []Point) error {
+	return w.append(encodeBatchRecord(points))
+}
+
+func encodeBatchRecord(points []Point) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(walBatch)
+	buf.Write(encodeUint32(uint32(len(points))))
+	for i := range points {
+		pointBytes := points[i].encode()
+		buf.Write(encodeUint32(uint32(len(pointBytes))))
+		buf.Write(pointBytes)
+	}
+	return buf.Bytes()
+}
+
+// decodeBatch decodes a batch record written by wal.batch.
+func decodeBatch(record []byte) ([]Point, error) {
+	if len(record) < 5 {
+		return nil, ErrLogCorrupted
+	}
+	count := int(decodeUint32(record[1:5]))
+	points := make([]Point, 0, count)
+
+	bufPos := 5
+	for i := 0; i < count; i++ {
+		if bufPos+4 > len(record) {
+			return nil, ErrLogCorrupted
+		}
+		pointLength := int(decodeUint32(record[bufPos : bufPos+4]))
+		bufPos += 4
+		if pointLength < 8 || bufPos+pointLength > len(record) {
+			return nil, ErrLogCorrupted
+		}
+		p, err := decodePoint(record[bufPos : bufPos+pointLength])
+		if err != nil {
+			return nil, err
+		}
+		bufPos += pointLength
+		points = append(points, *p)
+	}
+	return points, nil
+}
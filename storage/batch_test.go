@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPutBatch(t *testing.T) {
+	dir := t.TempDir()
+	single, err := Open(filepath.Join(dir, "single"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer single.Close()
+	batched, err := Open(filepath.Join(dir, "batched"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC).UnixNano()
+	b := batched.NewBatch()
+	for i := 0; i < 1000; i++ {
+		key := base + r.Int63n(int64(48*time.Hour))
+		if i%2 == 0 {
+			key = key / 1e9 * 1e9
+		}
+		value := map[string]float64{"price": float64(i)}
+		if err := single.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		b.Put(key, value)
+		if i == 10 {
+			// Duplicate keys keep the last value.
+			b.Put(key, map[string]float64{"price": -1})
+			b.Put(key, value)
+		}
+	}
+	if err := b.Write(); err != nil {
+		t.Fatal(err)
+	}
+
+	reducer := map[string]string{"price": "sum"}
+	check := func(db *DB) {
+		for _, level := range []uint16{LevelDay, LevelHour, LevelMinute} {
+			want, err := single.Query(base, base+int64(48*time.Hour), Group{Level: level}, reducer, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := db.Query(base, base+int64(48*time.Hour), Group{Level: level}, reducer, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("level %x: batch and single puts differ", level)
+			}
+		}
+	}
+	check(batched)
+
+	// Reopen without flushing, the batch is replayed from the log.
+	crash(t, batched)
+	batched, err = Open(filepath.Join(dir, "batched"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer batched.Close()
+	check(batched)
+}
+
+func BenchmarkPut(b *testing.B) {
+	db, err := Open(filepath.Join(b.TempDir(), "put"), &Options{SyncPolicy: SyncNever})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC).UnixNano()
+	value := map[string]float64{"price": 1}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.Put(base+int64(i)*int64(time.Millisecond), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPutBatch(b *testing.B) {
+	db, err := Open(filepath.Join(b.TempDir(), "batch"), &Options{SyncPolicy: SyncNever})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC).UnixNano()
+	value := map[string]float64{"price": 1}
+	batch := db.NewBatch()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		batch.Put(base+int64(i)*int64(time.Millisecond), value)
+		if batch.Len() == 1000 {
+			if err := batch.Write(); err != nil {
+				b.Fatal(err)
+			}
+			batch.Reset()
+		}
+	}
+	if err := batch.Write(); err != nil {
+		b.Fatal(err)
+	}
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+	"unsafe"
+)
+
+// DefaultCacheSize is the capacity of the node cache of a database opened
+// without Options.Cache.
+const DefaultCacheSize int64 = 32 << 20
+
+// Cache keeps recently read nodes in memory, so that queries do not read and
+// decode them again. Once the cached nodes take more than the capacity, the
+// least recently used ones are evicted. The size of a node is an estimate of
+// the memory it takes decoded, which is several times the size of its chunk
+// on disk.
+//
+// A Cache can be shared by several databases, to bound the memory of all of
+// them together. The cached nodes are never modified, a writer takes a node
+// out of the cache before it changes it.
+type Cache struct {
+	lock     sync.Mutex
+	capacity int64
+	size     int64
+	items    map[cacheKey]*list.Element
+	lru      *list.List // most recently used at the front
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type cacheKey struct {
+	db  *DB
+	pos int64
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	node *node
+	size int64
+}
+
+// CacheStats reports the usage of a Cache.
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Nodes     int   `json:"nodes"`
+	Bytes     int64 `json:"bytes"`
+	Capacity  int64 `json:"capacity"`
+}
+
+// NewCache returns a cache holding up to capacity bytes of nodes. With a
+// capacity of zero or less nothing is cached, but the stats are still kept.
+func NewCache(capacity int64) *Cache {
+	return &Cache{
+		capacity: capacity,
+		items:    make(map[cacheKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns the node of db at pos, if it is cached.
+func (c *Cache) get(db *DB, pos int64) (*node, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.items[cacheKey{db, pos}]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).node, true
+}
+
+// add caches the node of db at pos, and evicts nodes until it fits.
+func (c *Cache) add(db *DB, pos int64, n *node, size int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := cacheKey{db, pos}
+	if _, ok := c.items[key]; ok || size > c.capacity {
+		return
+	}
+	c.items[key] = c.lru.PushFront(&cacheEntry{key: key, node: n, size: size})
+	c.size += size
+	for c.size > c.capacity {
+		c.removeElement(c.lru.Back())
+		c.evictions++
+	}
+}
+
+// remove drops the node of db at pos.
+func (c *Cache) remove(db *DB, pos int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.items[cacheKey{db, pos}]; ok {
+		c.removeElement(e)
+	}
+}
+
+// purge drops every node of db, it is called when the positions of db change.
+func (c *Cache) purge(db *DB) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*cacheEntry).key.db == db {
+			c.removeElement(e)
+		}
+		e = next
+	}
+}
+
+func (c *Cache) removeElement(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.items, entry.key)
+	c.size -= entry.size
+}
+
+// mapEntrySize is the memory a map entry takes apart from its key and value:
+// the string header of the key, the hash bits and the free slots of the
+// buckets.
+const mapEntrySize = 32
+
+// memSize returns an estimate of the memory n takes decoded, with the maps
+// of the fields and the bins of their sketches.
+func (n *node) memSize() int64 {
+	size := int64(unsafe.Sizeof(*n))
+	for _, p := range n.points {
+		size += int64(unsafe.Sizeof(p) + unsafe.Sizeof(*p))
+		for k := range p.Value {
+			size += mapEntrySize + int64(len(k)) + 8
+		}
+	}
+	for _, np := range n.pointers {
+		size += int64(unsafe.Sizeof(np) + unsafe.Sizeof(*np))
+		for k, v := range np.value {
+			size += mapEntrySize + int64(len(k)) + int64(unsafe.Sizeof(v))
+			if v.sketch != nil {
+				bins := len(v.sketch.positive.counts) + len(v.sketch.negative.counts)
+				size += int64(unsafe.Sizeof(*v.sketch)) + 8*int64(bins)
+			}
+		}
+	}
+	return size
+}
+
+// Stats returns the usage of the cache.
+func (c *Cache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Nodes:     len(c.items),
+		Bytes:     c.size,
+		Capacity:  c.capacity,
+	}
+}
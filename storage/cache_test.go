@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheEviction(t *testing.T) {
+	db := &DB{}
+	c := NewCache(100)
+	for pos := int64(0); pos < 5; pos++ {
+		c.add(db, pos, &node{}, 30)
+	}
+	if s := c.Stats(); s.Nodes != 3 || s.Bytes != 90 || s.Evictions != 2 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	// Using a node keeps it, the least recently used one is evicted.
+	if _, ok := c.get(db, 2); !ok {
+		t.Fatal("expected node 2 to be cached")
+	}
+	c.add(db, 5, &node{}, 30)
+	if _, ok := c.get(db, 3); ok {
+		t.Fatal("expected node 3 to be evicted")
+	}
+	if _, ok := c.get(db, 2); !ok {
+		t.Fatal("expected node 2 to be cached")
+	}
+
+	c.add(db, 6, &node{}, 200)
+	c.purge(db)
+	if s := c.Stats(); s.Nodes != 0 || s.Bytes != 0 || s.Hits != 2 || s.Misses != 1 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+}
+
+func TestCacheQuery(t *testing.T) {
+	cache := NewCache(1 << 20)
+	db, err := Open(filepath.Join(t.TempDir(), "cache"), &Options{Cache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC).UnixNano()
+	for i := 0; i < 100; i++ {
+		if err := db.Put(base+int64(i)*int64(time.Hour), map[string]float64{"price": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func() map[int64]float64 {
+		points, err := db.Query(base, base+int64(100*time.Hour), Group{Level: LevelDay}, map[string]string{"price": "sum"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sums := make(map[int64]float64)
+		for _, p := range points {
+			sums[p.Timestamp] = p.Value["price"]
+		}
+		return sums
+	}
+	want := query()
+	misses := cache.Stats().Misses
+	if misses == 0 {
+		t.Fatal("expected the first query to read nodes")
+	}
+	if got := query(); len(got) != len(want) {
+		t.Fatalf("expected %d results, got %d", len(want), len(got))
+	}
+	if s := cache.Stats(); s.Misses != misses || s.Hits == 0 {
+		t.Fatalf("expected the second query to be served from the cache, got %+v", s)
+	}
+
+	// A change of a cached node is seen by the next query.
+	if err := db.Put(base, map[string]float64{"price": 1000}); err != nil {
+		t.Fatal(err)
+	}
+	day := time.Unix(0, base).UTC().Truncate(24 * time.Hour).UnixNano()
+	if got := query(); got[day] != want[day]+1000 {
+		t.Fatalf("expected %v, got %v", want[day]+1000, got[day])
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got := query(); got[day] != want[day]+1000 {
+		t.Fatalf("after flush: expected %v, got %v", want[day]+1000, got[day])
+	}
+}
+
+func TestCacheNodeSize(t *testing.T) {
+	cache := NewCache(1 << 20)
+	db, err := Open(filepath.Join(t.TempDir(), "cache"), &Options{Cache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Spread values give the sketches of the aggregates many bins.
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC)
+	v := 1.0
+	for i := 0; i < 2000; i++ {
+		v *= 1.01
+		if err := db.Put(base.Add(time.Duration(i)*time.Second).UnixNano(), map[string]float64{"price": v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The nodes are charged more than their chunks.
+	chunk, err := db.readChunkAt(db.meta.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := db.cachedNode(db.meta.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := n.memSize(); size <= chunkSize(chunk) {
+		t.Fatalf("expected more than %d bytes, got %d", chunkSize(chunk), size)
+	}
+	if s := cache.Stats(); s.Bytes != n.memSize() {
+		t.Fatalf("expected %d bytes cached, got %+v", n.memSize(), s)
+	}
+}
@@ -0,0 +1,102 @@
+package storage
+
+// Candle is the open, high, low and close price of a bucket, with the volume
+// traded and the number of prices.
+type Candle struct {
+	Timestamp int64   `json:"timestamp"`
+	Open      float64 `json:"open"`
+	High      float64 `json:"high"`
+	Low       float64 `json:"low"`
+	Close     float64 `json:"close"`
+	Volume    float64 `json:"volume"`
+	Count     uint64  `json:"count"`
+}
+
+// Candles returns the candles of the field price in the buckets of group,
+// from the bucket which from is in up to the last bucket starting before to.
+// The volume is the sum of the field volume, if not empty. Buckets without
+// prices are left out, or if fill is true, they are candles at the previous
+// close with no volume. The previous close may be from before from.
+func (db *DB) Candles(from int64, to int64, group Group, price string, volume string, fill bool) ([]*Candle, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	if !db.opened {
+		return nil, ErrDatabaseNotOpen
+	}
+	if err := group.validate(); err != nil {
+		return nil, err
+	}
+
+	if group.Location == nil {
+		group.Location = db.loc
+	}
+	next := group.start(from, group.Location)
+	var close float64
+	var closed bool
+	if fill {
+		var err error
+		if close, closed, err = db.lastBefore(next, price); err != nil {
+			return nil, err
+		}
+	}
+
+	var result []*Candle
+	var err error
+	fillTo := func(end int64) {
+		if !fill || !closed {
+			return
+		}
+		for ; next < end && err == nil; next = group.next(next, group.Location) {
+			if len(result) >= MaxBuckets {
+				err = ErrTooManyBuckets
+				break
+			}
+			result = append(result, &Candle{Timestamp: next, Open: close, High: close, Low: close, Close: close})
+		}
+	}
+	aggErr := db.aggregate(from, to, group, nil, func(key int64, value map[string]Value) bool {
+		v, ok := value[price]
+		if !ok {
+			return true
+		}
+		fillTo(key)
+		candle := &Candle{
+			Timestamp: key,
+			Open:      v.first,
+			High:      v.max,
+			Low:       v.min,
+			Close:     v.last,
+			Count:     v.count,
+		}
+		if vol, ok := value[volume]; ok && volume != "" {
+			candle.Volume = vol.sum
+		}
+		result = append(result, candle)
+		close, closed = v.last, true
+		next = group.next(key, group.Location)
+		return true
+	})
+	if aggErr != nil {
+		return nil, aggErr
+	}
+	fillTo(to)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// lastBefore returns the last value of field before ts, false if there is
+// none.
+func (db *DB) lastBefore(ts int64, field string) (float64, bool, error) {
+	c := db.Cursor()
+	c.level = LevelNSecond
+	ok, err := c.seekBefore(ts)
+	for ; ok && err == nil; ok, err = c.prev() {
+		if v, ok := c.point().Value[field]; ok {
+			return v, true, nil
+		}
+	}
+	return 0, false, err
+}
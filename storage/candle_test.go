@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCandles(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "candles"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Trades every minute from 9:00 to 9:59, but not from 9:20 to 9:39.
+	base := time.Date(2016, 8, 28, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 60; i++ {
+		if i >= 20 && i < 40 {
+			continue
+		}
+		value := map[string]float64{"price": float64(100 + i%7), "volume": 10}
+		if err := db.Put(base.Add(time.Duration(i)*time.Minute).UnixNano(), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	group := Group{Level: LevelMinute, Count: 10}
+	minutes := func(m int) int64 {
+		return base.Add(time.Duration(m) * time.Minute).UnixNano()
+	}
+
+	candles, err := db.Candles(minutes(-30), minutes(60), group, "price", "volume", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Candle{
+		{Timestamp: minutes(0), Open: 100, High: 106, Low: 100, Close: 102, Volume: 100, Count: 10},
+		{Timestamp: minutes(10), Open: 103, High: 106, Low: 100, Close: 105, Volume: 100, Count: 10},
+		{Timestamp: minutes(40), Open: 105, High: 106, Low: 100, Close: 100, Volume: 100, Count: 10},
+		{Timestamp: minutes(50), Open: 101, High: 106, Low: 100, Close: 103, Volume: 100, Count: 10},
+	}
+	checkCandles(t, candles, want)
+
+	// Empty buckets are at the previous close, from before from too.
+	candles, err = db.Candles(minutes(15), minutes(70), group, "price", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []*Candle{
+		{Timestamp: minutes(10), Open: 103, High: 106, Low: 100, Close: 105, Count: 10},
+		{Timestamp: minutes(20), Open: 105, High: 105, Low: 105, Close: 105},
+		{Timestamp: minutes(30), Open: 105, High: 105, Low: 105, Close: 105},
+		{Timestamp: minutes(40), Open: 105, High: 106, Low: 100, Close: 100, Count: 10},
+		{Timestamp: minutes(50), Open: 101, High: 106, Low: 100, Close: 103, Count: 10},
+		{Timestamp: minutes(60), Open: 103, High: 103, Low: 103, Close: 103},
+	}
+	checkCandles(t, candles, want)
+
+	candles, err = db.Candles(minutes(25), minutes(40), group, "price", "volume", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []*Candle{
+		{Timestamp: minutes(20), Open: 105, High: 105, Low: 105, Close: 105},
+		{Timestamp: minutes(30), Open: 105, High: 105, Low: 105, Close: 105},
+	}
+	checkCandles(t, candles, want)
+
+	// Nothing to fill with before the first trade.
+	candles, err = db.Candles(minutes(-30), minutes(10), group, "price", "volume", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCandles(t, candles, []*Candle{{Timestamp: minutes(0), Open: 100, High: 106, Low: 100, Close: 102, Volume: 100, Count: 10}})
+
+	if _, err := db.Candles(minutes(0), minutes(60), Group{Level: LevelNSecond}, "price", "", true); err != ErrTooManyBuckets {
+		t.Fatalf("expected ErrTooManyBuckets, got %v", err)
+	}
+}
+
+func checkCandles(t *testing.T, got, want []*Candle) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("expected %d candles, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if *got[i] != *want[i] {
+			t.Fatalf("candle %d: expected %+v, got %+v", i, *want[i], *got[i])
+		}
+	}
+}
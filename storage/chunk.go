@@ -9,20 +9,28 @@ const ChunkCrcSize int64 = 4
 
 // read a chunk at the specified location
 func (db *DB) readChunkAt(pos int64) ([]byte, error) {
+	return readChunk(&db.ops, pos)
+}
+
+// readChunk reads a chunk at the specified location of the file behind ops.
+func readChunk(ops *Ops, pos int64) ([]byte, error) {
 	// chunk starts with 8 bytes (32bit length, 32bit crc)
 	chunkPrefix := make([]byte, ChunkLengthSize+ChunkCrcSize)
-	n, err := db.ops.ReadAt(chunkPrefix, pos)
+	n, err := ops.ReadAt(chunkPrefix, pos)
 	if err != nil {
 		return nil, err
 	}
 
 	size := decodeUint32(chunkPrefix[0:ChunkLengthSize])
 	crc := decodeUint32(chunkPrefix[ChunkLengthSize : ChunkLengthSize+ChunkCrcSize])
+	if size < uint32(ChunkCrcSize) {
+		return nil, ErrChunkBadCrc
+	}
 
 	size -= uint32(ChunkLengthSize)
 	data := make([]byte, size)
 	pos += int64(n)
-	n, err = db.ops.ReadAt(data, pos)
+	n, err = ops.ReadAt(data, pos)
 	if uint32(n) < size {
 		return nil, ErrChunkDataLessThanSize
 	}
@@ -35,6 +43,22 @@ func (db *DB) readChunkAt(pos int64) ([]byte, error) {
 	return data, nil
 }
 
+// chunkSize returns the number of bytes a chunk with the given payload takes on disk.
+func chunkSize(data []byte) int64 {
+	return ChunkLengthSize + ChunkCrcSize + int64(len(data))
+}
+
+// encodeChunk frames buf the same way writeChunk does, so it can be written with a single call.
+func encodeChunk(buf []byte) []byte {
+	size := uint32(len(buf)) + uint32(ChunkCrcSize)
+
+	chunk := make([]byte, 0, chunkSize(buf))
+	chunk = append(chunk, encodeUint32(size)...)
+	chunk = append(chunk, encodeUint32(crc32.ChecksumIEEE(buf))...)
+	chunk = append(chunk, buf...)
+	return chunk
+}
+
 // write chunk at the specified location, after the end as usually
 func (db *DB) writeChunk(buf []byte) (int64, int64, error) {
 	startPos := db.pos
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// CompactSuffix is appended to the path of a database to name the file Vacuum
+// writes before it is swapped in.
+const CompactSuffix = ".compact"
+
+// Compact writes the live tree, including the changes which are not flushed
+// yet, into a new database file at dst. Old versions of the chunks are left
+// behind, so the new file is usually a lot smaller.
+func (db *DB) Compact(dst string) error {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	return db.compact(dst)
+}
+
+func (db *DB) compact(dst string) error {
+	out := &DB{path: dst}
+
+	var err error
+	if out.file, err = out.ops.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, db.mode); err != nil {
+		return err
+	}
+	defer out.ops.Close()
+
+	out.pos = int64(MetaSize)
+	m := &meta{}
+	db.meta.copy(m)
+	if m.root, err = db.root.copyTo(out); err != nil {
+		return err
+	}
+	if err = out.ops.Sync(); err != nil {
+		return err
+	}
+
+	// Fill both slots like Open does for a new database.
+	if err = out.writeMeta(m); err != nil {
+		return err
+	}
+	m.txid++
+	if err = out.writeMeta(m); err != nil {
+		return err
+	}
+	return out.ops.Sync()
+}
+
+// Vacuum compacts the database online: the tree is flushed, copied into a new
+// file next to the database and the new file is renamed over the old one.
+// It returns the size of the file before and after.
+func (db *DB) Vacuum() (int64, int64, error) {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return 0, 0, ErrDatabaseNotOpen
+	}
+	if db.readOnly {
+		return 0, 0, ErrDatabaseReadOnly
+	}
+	if err := db.flush(); err != nil {
+		return 0, 0, err
+	}
+	before := db.pos
+
+	tmp := db.path + CompactSuffix
+	if err := db.compact(tmp); err != nil {
+		os.Remove(tmp)
+		return before, before, err
+	}
+
+	// Lock the new file before it is visible under the path of the database.
+	f, err := os.OpenFile(tmp, os.O_RDWR, db.mode)
+	if err != nil {
+		os.Remove(tmp)
+		return before, before, err
+	}
+	if err = flock(f, true, 0); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return before, before, err
+	}
+	if err = os.Rename(tmp, db.path); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return before, before, err
+	}
+
+	// Switch to the new file, the positions of the loaded nodes are stale.
+	// The path refers to the new file now, so this is done even if the
+	// rename is not durable yet.
+	syncErr := syncDir(filepath.Dir(db.path))
+	db.cache.purge(db)
+	db.ops.Close()
+	db.ops.File = f
+	db.file = f
+
+	// If the new file cannot be loaded, the database is closed rather than
+	// left without a tree, later calls return ErrDatabaseNotOpen.
+	if db.pos, err = db.ops.GotoEOF(); err != nil {
+		db.close()
+		return before, before, err
+	}
+	db.meta = nil
+	if err = db.loadMeta(); err != nil {
+		db.close()
+		return before, before, err
+	}
+	if db.root, err = db.node(db.meta.root); err != nil {
+		db.close()
+		return before, before, err
+	}
+	return before, db.pos, syncErr
+}
+
+// copyTo writes the subtree of n into dst and returns its position there.
+// Children which are not in memory are read without being kept.
+func (n *node) copyTo(dst *DB) (int64, error) {
+	if n.isLeaf {
+		pos, _, err := dst.writeChunk(n.encode())
+		return pos, err
+	}
+
+	c := dst.newInteriorNode()
+	c.level = n.level
+	for i, np := range n.pointers {
+		child, err := n.load(i)
+		if err != nil {
+			return 0, err
+		}
+		pos, err := child.copyTo(dst)
+		if err != nil {
+			return 0, err
+		}
+		c.pointers = append(c.pointers, &nodePointer{
+			key:   np.key,
+			pos:   pos,
+			value: np.value,
+		})
+	}
+	pos, _, err := dst.writeChunk(c.encode())
+	return pos, err
+}
+
+// syncDir makes a rename in the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
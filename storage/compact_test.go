@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVacuum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "compact")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2016, 8, 28, 21, 24, 0, 0, time.UTC).UnixNano()
+	for i := 0; i < 200; i++ {
+		if err := db.Put(base+int64(i)*int64(time.Minute), map[string]float64{"price": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before, after, err := db.Vacuum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before {
+		t.Fatalf("expected the file to shrink, before %d after %d", before, after)
+	}
+
+	check := func(db *DB) {
+		for i := 0; i < 200; i++ {
+			p, err := db.Get(base + int64(i)*int64(time.Minute))
+			if err != nil {
+				t.Fatalf("point %d: %v", i, err)
+			}
+			if p.Value["price"] != float64(i) {
+				t.Fatalf("point %d: unexpected value %v", i, p.Value)
+			}
+		}
+	}
+	check(db)
+
+	// The database keeps working on the new file.
+	if err := db.Put(base-int64(time.Minute), map[string]float64{"price": -1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+	if _, err := db.Get(base - int64(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "src"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	key := time.Date(2016, 8, 28, 21, 24, 0, 0, time.UTC).UnixNano()
+	if err := db.Put(key, map[string]float64{"price": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unflushed changes are part of the copy.
+	dst := filepath.Join(dir, "dst")
+	if err := db.Compact(dst); err != nil {
+		t.Fatal(err)
+	}
+	out, err := Open(dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if _, err := out.Get(key); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,10 +5,9 @@ import (
 )
 
 type Cursor struct {
-	db      *DB
-	level   uint16
-	reducer map[string]string
-	stack   []elemRef
+	db    *DB
+	level uint16 // level of the elements the cursor moves between
+	stack []elemRef
 }
 
 // fix position to insert data.
@@ -33,146 +32,166 @@ func (c *Cursor) fix(t *Time, n *node) error {
 
 	// If the inserted node is not equal dirty node, flush the dirty.
 	// Only one dirty branch in the tree.
-	if n.dirty != -1 && n.dirty != index {
-		n.pointers[n.dirty].pointer.reduce()
-		n.pointers[n.dirty].pos = n.pointers[n.dirty].pointer.flush()
+	found := index < len(n.pointers) && n.pointers[index].key == ts
+	if !found || n.dirty != index {
+		if err := n.flushDirty(); err != nil {
+			return err
+		}
 	}
 
 	// Cannot find the key == ts
-	if index == len(n.pointers) || n.pointers[index].key != ts {
+	if !found {
 		return nil
 	}
 
 	// Continue to fix to the insert node
-	child := n.pointers[index].pointer
-	if child == nil {
-		var err error
-		child, err = c.db.node(n.pointers[index].pos)
-		child.parent = n
-		if err != nil {
-			return err
-		}
-		n.pointers[index].pointer = child
-		n.dirty = index
+	child, err := n.child(index)
+	if err != nil {
+		return err
 	}
+	n.dirty = index
 
-	e = elemRef{node: child}
-	c.stack = append(c.stack, e)
 	return c.fix(t, child)
 }
 
-// seek moves the cursor to a given key and returns it.
-// If the key does not exist then the next key is used.
-func (c *Cursor) seek(seek int64) {
+// seek moves the cursor to the first element at or after the period of the
+// cursor level that ts is in. It returns false if there is no such element.
+func (c *Cursor) seek(ts int64) (bool, error) {
 	_assert(c.db != nil, "tx closed")
 
 	// Start from root and traverse to correct position.
 	c.stack = c.stack[:0]
-	t := NewTime(seek)
-	c.search(&t, c.db.root)
-}
+	t := c.db.newTime(ts)
+	n := c.db.root
+	for {
+		e := elemRef{node: n}
+		if n.isLeaf {
+			key := t.Timestamp(c.level)
+			e.index = sort.Search(len(n.points), func(i int) bool {
+				return n.points[i].Timestamp >= key
+			})
+			c.stack = append(c.stack, e)
+			break
+		}
 
-// next moves the cursor to next node.
-func (c *Cursor) next() bool {
-	ref := &c.stack[len(c.stack)-1]
-	ref.index++
-	if ref.count() == 0 || ref.index >= ref.count() {
-		if len(c.stack) <= 1 {
-			return true
+		key := t.Timestamp(n.level << 1)
+		e.index = sort.Search(len(n.pointers), func(i int) bool {
+			return n.pointers[i].key >= key
+		})
+		c.stack = append(c.stack, e)
+		if n.level >= c.level>>1 || e.index >= len(n.pointers) {
+			break
+		}
+		if n.pointers[e.index].key != key {
+			// The child starts after t, its first element is the one.
+			return c.first()
 		}
-		c.stack = c.stack[:len(c.stack)-1]
-		ref = &c.stack[len(c.stack)-1]
 
-		c.next()
-		return false
+		child, err := n.load(e.index)
+		if err != nil {
+			return false, err
+		}
+		n = child
 	}
 
-	if !ref.node.isLeaf && ref.node.level < c.level>>1 {
-		c.first()
+	if ref := &c.stack[len(c.stack)-1]; ref.index >= ref.count() {
+		return c.next()
 	}
-	return false
+	return true, nil
 }
 
-// find the first node equal the level.
-func (c *Cursor) first() error {
-	ref := &c.stack[len(c.stack)-1]
-	var n *node
-	if ref.node.pointers[ref.index].pointer == nil {
-		var err error
-		n, err = c.db.node(ref.node.pointers[ref.index].pos)
-		if err != nil {
-			return err
-		}
-	} else {
-		n = ref.node.pointers[ref.index].pointer
+// seekBefore moves the cursor to the last element before the period of the
+// cursor level that ts is in. It returns false if there is no such element.
+func (c *Cursor) seekBefore(ts int64) (bool, error) {
+	ok, err := c.seek(ts)
+	if err != nil {
+		return false, err
 	}
-
-	e := elemRef{node: n}
-	c.stack = append(c.stack, e)
-
-	if !n.isLeaf && n.level < c.level>>1 {
-		return c.first()
+	if !ok {
+		// Past the end, the last element is the one.
+		root := elemRef{node: c.db.root}
+		root.index = root.count()
+		c.stack = append(c.stack[:0], root)
 	}
-
-	return nil
+	return c.prev()
 }
 
-// prev moves the cursor to next node.
-func (c *Cursor) prev() bool {
-	ref := &c.stack[len(c.stack)-1]
-	ref.index--
-	if ref.count() == 0 || ref.index < 0 {
-		if len(c.stack) <= 1 {
-			return true
+// next moves the cursor to the next element, it returns false at the end.
+func (c *Cursor) next() (bool, error) {
+	for {
+		ref := &c.stack[len(c.stack)-1]
+		ref.index++
+		if ref.index < ref.count() {
+			break
+		}
+		if len(c.stack) == 1 {
+			return false, nil
 		}
 		c.stack = c.stack[:len(c.stack)-1]
-		ref = &c.stack[len(c.stack)-1]
-
-		return c.prev()
 	}
-
-	if !ref.node.isLeaf && ref.node.level < c.level>>1 {
-		c.last()
-	}
-	return false
+	return c.first()
 }
 
-// find the last node equal the level.
-func (c *Cursor) last() error {
-	ref := &c.stack[len(c.stack)-1]
-	var n *node
-	if ref.node.pointers[ref.index].pointer == nil {
-		var err error
-		n, err = c.db.node(ref.node.pointers[ref.index].pos)
+// first descends from the current position to the first element at the level
+// of the cursor.
+func (c *Cursor) first() (bool, error) {
+	for {
+		ref := &c.stack[len(c.stack)-1]
+		if ref.index >= ref.count() {
+			return c.next()
+		}
+		if ref.isLeaf() || ref.node.level >= c.level>>1 {
+			return true, nil
+		}
+
+		n, err := ref.node.load(ref.index)
 		if err != nil {
-			return err
+			return false, err
 		}
-	} else {
-		n = ref.node.pointers[ref.index].pointer
+		c.stack = append(c.stack, elemRef{node: n})
 	}
+}
 
-	e := elemRef{node: n, index: len(n.pointers) - 1}
-	c.stack = append(c.stack, e)
-
-	if !n.isLeaf && n.level < c.level>>1 {
-		return c.last()
+// prev moves the cursor to the previous element, it returns false at the
+// beginning.
+func (c *Cursor) prev() (bool, error) {
+	for {
+		ref := &c.stack[len(c.stack)-1]
+		ref.index--
+		if ref.index >= 0 && ref.index < ref.count() {
+			break
+		}
+		if len(c.stack) == 1 {
+			return false, nil
+		}
+		c.stack = c.stack[:len(c.stack)-1]
 	}
-	return nil
+	return c.last()
 }
 
-func (c *Cursor) points() []*Point {
-	var points []*Point
-	ref := &c.stack[len(c.stack)-1]
-	if ref.count() == 0 || ref.index >= ref.count() {
-		return points
-	}
-	for i := ref.index; i < ref.count(); i++ {
-		points = append(points, ref.reduce(c.reducer))
+// last descends from the current position to the last element at the level
+// of the cursor.
+func (c *Cursor) last() (bool, error) {
+	for {
+		ref := &c.stack[len(c.stack)-1]
+		if ref.index < 0 || ref.index >= ref.count() {
+			return c.prev()
+		}
+		if ref.isLeaf() || ref.node.level >= c.level>>1 {
+			return true, nil
+		}
+
+		n, err := ref.node.load(ref.index)
+		if err != nil {
+			return false, err
+		}
+		e := elemRef{node: n}
+		e.index = e.count() - 1
+		c.stack = append(c.stack, e)
 	}
-	return points
 }
 
-// keyValue returns the key and value of the current cursor.
+// point returns the point the cursor is positioned on, if it is in a leaf.
 func (c *Cursor) point() *Point {
 	ref := &c.stack[len(c.stack)-1]
 	if ref.isLeaf() {
@@ -184,60 +203,20 @@ func (c *Cursor) point() *Point {
 	return nil
 }
 
-// search recursively performs a binary search against a given node until it finds a given key.
-func (c *Cursor) search(t *Time, n *node) error {
-	e := elemRef{node: n}
-	c.stack = append(c.stack, e)
-
-	if n.isLeaf {
-		c.searchLeaf(t)
-	} else {
-		c.searchInterior(t)
-	}
-	return nil
-}
-
-func (c *Cursor) searchInterior(t *Time) {
-	e := &c.stack[len(c.stack)-1]
-	n := e.node
-	ts := t.Timestamp(n.level << 1)
-	index := sort.Search(len(n.pointers), func(i int) bool {
-		return n.pointers[i].key >= ts
-	})
-	e.index = index
-
-	if n.level<<1 >= c.level {
-		return
-	}
-
-	if index >= len(n.pointers) {
-		c.next()
-		return
-	}
-
-	if n.pointers[index].pointer == nil {
-		var err error
-		n.pointers[index].pointer, err = n.db.node(n.pointers[index].pos)
-		if err != nil {
-			return
+// element returns the start of the period of the current element and the
+// aggregates of its fields. The aggregates must not be modified.
+func (c *Cursor) element() (int64, map[string]Value) {
+	ref := &c.stack[len(c.stack)-1]
+	if ref.isLeaf() {
+		point := ref.node.points[ref.index]
+		value := make(map[string]Value, len(point.Value))
+		for k, v := range point.Value {
+			value[k] = pointValue(point.Timestamp, v)
 		}
+		return point.Timestamp, value
 	}
-	c.search(t, n.pointers[index].pointer)
-}
-
-func (c *Cursor) searchLeaf(t *Time) {
-	e := &c.stack[len(c.stack)-1]
-	n := e.node
-	ts := t.Timestamp(n.level << 1)
-	index := sort.Search(len(n.points), func(i int) bool {
-		return n.points[i].Timestamp >= ts
-	})
-	e.index = index
-
-	if index >= len(n.points) {
-		c.next()
-		return
-	}
+	pointer := ref.node.pointers[ref.index]
+	return pointer.key, pointer.value
 }
 
 // node returns the node that the cursor is currently positioned on.
@@ -265,88 +244,3 @@ func (r *elemRef) count() int {
 	}
 	return len(r.node.pointers)
 }
-
-func (r *elemRef) reduce(reducer map[string]string) *Point {
-	if r.isLeaf() {
-		point := r.node.points[r.index]
-		value := make(map[string]float64)
-
-		for field, _ := range reducer {
-			if field == "count" {
-				value["count"] = 1
-			} else {
-				v, ok := point.Value[field]
-				if ok {
-					value[field] = v
-				} else {
-					value[field] = 0.0
-				}
-			}
-		}
-		point.Value = value
-		return point
-	}
-
-	pointer := r.node.pointers[r.index]
-	value := make(map[string]float64)
-
-	for field, r := range reducer {
-		switch r {
-		case "sum":
-			v, ok := pointer.value[field]
-			if ok {
-				value[field] = v.sum
-			} else {
-				value[field] = 0.0
-			}
-		case "max":
-			v, ok := pointer.value[field]
-			if ok {
-				value[field] = v.max
-			} else {
-				value[field] = 0.0
-			}
-		case "min":
-			v, ok := pointer.value[field]
-			if ok {
-				value[field] = v.min
-			} else {
-				value[field] = 0.0
-			}
-		case "first":
-			v, ok := pointer.value[field]
-			if ok {
-				value[field] = v.first
-			} else {
-				value[field] = 0.0
-			}
-		case "last":
-			v, ok := pointer.value[field]
-			if ok {
-				value[field] = v.last
-			} else {
-				value[field] = 0.0
-			}
-		case "count":
-			v, ok := pointer.value[field]
-			if ok {
-				value[field] = v.last
-			} else {
-				value[field] = 0.0
-			}
-		case "avg":
-			fallthrough
-		case "ma":
-			v, ok := pointer.value[field]
-			if ok {
-				value[field] = v.sum / float64(v.count)
-			} else {
-				value[field] = 0.0
-			}
-		}
-	}
-	return &Point{
-		Timestamp: pointer.key,
-		Value:     value,
-	}
-}
@@ -3,8 +3,11 @@ package storage
 import (
 	"bytes"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"os"
 	"sync"
+	"time"
 )
 
 type DB struct {
@@ -12,58 +15,222 @@ type DB struct {
 	file     *os.File
 	meta     *meta
 	pos      int64
-	metalock sync.Mutex // Allows only one writer at a time.
-	rwlock   sync.Mutex // Allows only one writer at a time.
-	root     *node      // root node in memory, need flush
+	metalock sync.Mutex   // Allows only one writer at a time.
+	rwlock   sync.RWMutex // Allows one writer or many readers at a time.
+	root     *node        // root node in memory, need flush
+	wal      *wal         // changes of root since the last flush
+	txlog    *TxLog       // outcome of the transactions in wal
+	cache    *Cache       // nodes read by queries
+	loc      *time.Location
+	opened   bool
+	readOnly bool
+	mode     os.FileMode
 
 	ops Ops
 }
 
-func Open(path string) (*DB, error) {
-	db := &DB{path: path}
+// Options represents the options that can be set when opening a database.
+type Options struct {
+	// SyncPolicy sets when the write-ahead log is fsynced.
+	SyncPolicy SyncPolicy
 
-	var err error
-	if db.file, err = db.ops.OpenFile(db.path, os.O_RDWR|os.O_CREATE, 0666); err != nil {
-		_ = db.Close()
+	// SyncInterval is the period of the background fsync under SyncInterval.
+	SyncInterval time.Duration
+
+	// TxLog is the transaction log shared with the other databases of
+	// transactions. It is required to replay such transactions.
+	TxLog *TxLog
+
+	// Timeout is the amount of time to wait to obtain a file lock.
+	// When set to zero it will wait indefinitely.
+	Timeout time.Duration
+
+	// Mode is the permission of the files created by Open, 0666 if zero.
+	Mode os.FileMode
+
+	// Location is the time zone of the calendar levels of a new database,
+	// UTC if nil. It is stored in the database, an existing database keeps
+	// the time zone it was created with.
+	Location *time.Location
+
+	// Cache holds the nodes read from disk, it may be shared with other
+	// databases. If nil, the database gets a cache of DefaultCacheSize.
+	Cache *Cache
+
+	// ReadOnly opens the database with a shared lock, so it can be read by
+	// several processes at once. The database must exist, and changes are
+	// refused with ErrDatabaseReadOnly. The file is mapped into memory,
+	// which suits snapshots that do not change anymore.
+	ReadOnly bool
+}
+
+// DefaultOptions represent the options used if nil options are passed into Open().
+var DefaultOptions = &Options{
+	SyncPolicy:   SyncAlways,
+	SyncInterval: 100 * time.Millisecond,
+}
+
+// fileMode returns the permission of new files.
+func (o *Options) fileMode() os.FileMode {
+	if o.Mode == 0 {
+		return 0666
+	}
+	return o.Mode
+}
+
+// Open opens the database at path, creating it if needed. The file is locked
+// exclusively, or shared with ReadOnly, until the database is closed. If the
+// lock cannot be obtained within options.Timeout, ErrTimeout is returned.
+func Open(path string, options *Options) (*DB, error) {
+	if options == nil {
+		options = DefaultOptions
+	}
+	db := &DB{
+		path:     path,
+		txlog:    options.TxLog,
+		cache:    options.Cache,
+		readOnly: options.ReadOnly,
+		mode:     options.fileMode(),
+	}
+	if db.cache == nil {
+		db.cache = NewCache(DefaultCacheSize)
+	}
+	if db.loc = options.Location; db.loc == nil {
+		db.loc = time.UTC
+	}
+
+	if err := db.open(options); err != nil {
+		_ = db.close()
 		return nil, err
 	}
+	db.opened = true
+	return db, nil
+}
+
+// open opens the files of the database and loads the root node. The files
+// opened so far are left for the caller to close on error.
+func (db *DB) open(options *Options) error {
+	flag := os.O_RDWR | os.O_CREATE
+	if db.readOnly {
+		flag = os.O_RDONLY
+	}
+
+	var err error
+	if db.file, err = db.ops.OpenFile(db.path, flag, db.mode); err != nil {
+		return err
+	}
+
+	// Lock the file, so that another process cannot write it at the same time.
+	if err = flock(db.file, !db.readOnly, options.Timeout); err != nil {
+		return err
+	}
 
 	db.pos, err = db.ops.GotoEOF()
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	// A read-only database is never appended to, so the mapping covers it.
+	if db.readOnly {
+		if db.pos == 0 {
+			return ErrInvalid
+		}
+		if db.ops.data, err = mmap(db.file, db.pos); err != nil {
+			return err
+		}
 	}
 
 	// Check db whether exists.
 	if db.pos == 0 {
-		// Write meta
-		db.meta = newMeta()
-		err = db.writeMeta(db.meta)
-		if err != nil {
-			return nil, err
+		// The zone is stored by name, it must be found again by Open.
+		if _, err = time.LoadLocation(db.loc.String()); err != nil {
+			return err
 		}
 
 		// Write root
 		root := db.newLeafNode()
 		root.level = LevelRoot
 		db.pos = int64(MetaSize)
-		db.writeChunk(root.encode())
-
+		if _, _, err = db.writeChunk(root.encode()); err != nil {
+			return err
+		}
 		db.root = root
+
+		// Write meta, both slots are filled so that a torn write of the
+		// first flush still leaves a valid one.
+		db.meta = newMeta(db.loc.String())
+		if err = db.writeMeta(db.meta); err != nil {
+			return err
+		}
+		db.meta.txid++
+		if err = db.writeMeta(db.meta); err != nil {
+			return err
+		}
+		if err = db.ops.Sync(); err != nil {
+			return err
+		}
+	} else if db.pos < int64(MetaSize) {
+		return ErrInvalid
 	} else {
 		// Read meta
 		err = db.loadMeta()
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if db.loc, err = time.LoadLocation(db.meta.zone); err != nil {
+			return err
 		}
 
 		// Read root
 		db.root, err = db.node(db.meta.root)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	return db, nil
+	// Redo the changes which were not flushed before the last shutdown.
+	if db.readOnly {
+		return readWAL(db.path+WALSuffix, db.apply)
+	}
+	if db.wal, err = openWAL(db.path+WALSuffix, options); err != nil {
+		return err
+	}
+	return db.wal.replay(db.apply)
+}
+
+// apply redoes a change read back from the write-ahead log.
+func (db *DB) apply(record []byte) error {
+	switch {
+	case len(record) >= 9 && record[0] == walPut:
+		p, err := decodePoint(record[1:])
+		if err != nil {
+			return err
+		}
+		return db.put(p.Timestamp, p.Value)
+	case len(record) == 17 && record[0] == walDelete:
+		return db.delete(decodeInt64(record[1:9]), decodeInt64(record[9:17]))
+	case len(record) > 0 && record[0] == walBatch:
+		points, err := decodeBatch(record)
+		if err != nil {
+			return err
+		}
+		return db.putBatch(points)
+	case len(record) > 0 && record[0] == walTx:
+		txid, records, err := decodeTxRecord(record)
+		if err != nil {
+			return err
+		}
+		if txid != 0 {
+			if db.txlog == nil {
+				return ErrTxLogRequired
+			}
+			if !db.txlog.Committed(txid) {
+				return nil
+			}
+		}
+		return db.applyTx(records)
+	}
+	return ErrLogCorrupted
 }
 
 // node read a chunk in the given positon, return node object.
@@ -75,89 +242,173 @@ func (db *DB) node(pos int64) (*node, error) {
 	return db.decodeNode(nodeBytes)
 }
 
-func (db *DB) loadMeta() error {
-	chunk, err := db.readChunkAt(0)
+// cachedNode returns the node at pos like node does, but keeps it in the
+// cache. The node may be shared with other readers, it must not be modified.
+func (db *DB) cachedNode(pos int64) (*node, error) {
+	if n, ok := db.cache.get(db, pos); ok {
+		return n, nil
+	}
+	nodeBytes, err := db.readChunkAt(pos)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	db.meta, err = newMetaFromBytes(chunk)
+	n, err := db.decodeNode(nodeBytes)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	db.cache.add(db, pos, n, n.memSize())
+	return n, nil
 }
 
-func (db *DB) writeMeta(m *meta) error {
-	metaBytes := m.toBytes()
+// CacheStats returns the usage of the node cache of the database, which may
+// be shared with other databases.
+func (db *DB) CacheStats() CacheStats {
+	return db.cache.Stats()
+}
 
-	pos := db.pos
-	db.pos = 0
-	_, _, err := db.writeChunk(metaBytes)
-	db.pos = pos
+// loadMeta reads both meta slots and uses the valid one with the highest
+// transaction id. If neither is valid the error of the first slot is returned.
+func (db *DB) loadMeta() error {
+	var metaErr error
+	for slot := int64(0); slot < MetaSlots; slot++ {
+		buf := make([]byte, metaSlotSize)
+		if _, err := db.ops.ReadAt(buf, slot*metaSlotSize); err != nil {
+			return err
+		}
 
-	if err != nil {
-		return err
+		m := newMetaFromBytes(buf)
+		if err := m.validate(); err != nil {
+			if metaErr == nil {
+				metaErr = err
+			}
+			continue
+		}
+		if db.meta == nil || m.txid > db.meta.txid {
+			db.meta = m
+		}
+	}
+	if db.meta == nil {
+		return metaErr
 	}
 	return nil
 }
 
+// writeMeta writes m into the slot of its transaction id, the slot of the
+// previous transaction is left intact in case the write is torn.
+func (db *DB) writeMeta(m *meta) error {
+	_, err := db.ops.WriteAt(m.toBytes(), int64(m.txid%uint64(MetaSlots))*metaSlotSize)
+	return err
+}
+
+// Location returns the time zone the calendar levels of the database are in.
+func (db *DB) Location() *time.Location {
+	return db.loc
+}
+
+// newTime returns the time tm in the time zone of the database.
+func (db *DB) newTime(tm int64) Time {
+	return NewTimeIn(tm, db.loc)
+}
+
 // Path returns the path to currently open database file.
 func (db *DB) Path() string {
 	return db.path
 }
 
-// Build a query
-func (db *DB) Query(from int64, to int64, level uint16, count int, reducer map[string]string) []*Point {
-	c := db.Cursor()
-	c.level = level
-	c.reducer = reducer
-
-	var result []*Point
-	c.seek(from)
-	for {
-		points := c.points()
-		result = append(result, points...)
-		if c.next() {
-			break
-		}
+// Get returns a copy of the point stored at key.
+func (db *DB) Get(key int64) (*Point, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	if !db.opened {
+		return nil, ErrDatabaseNotOpen
 	}
-	return result
-}
 
-func (db *DB) Get(key int64) (*Point, error) {
 	c := db.Cursor()
 	c.level = LevelNSecond
 
-	c.seek(key)
+	ok, err := c.seek(key)
+	if err != nil {
+		return nil, err
+	}
 	point := c.point()
-	if point.Timestamp == key {
-		return point, nil
+	if ok && point != nil && point.Timestamp == key {
+		value := make(map[string]float64, len(point.Value))
+		for k, v := range point.Value {
+			value[k] = v
+		}
+		return &Point{Timestamp: point.Timestamp, Value: value}, nil
 	}
 
 	return nil, ErrNotFound
 }
 
-// put insert data, key is unixnano.
+// Put inserts data, key is unixnano. The point is logged before it is
+// applied, so it survives a crash even if it is never flushed.
 func (db *DB) Put(key int64, value map[string]float64) error {
-	tm := NewTime(key)
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	if err := db.wal.put(key, value); err != nil {
+		return err
+	}
+	return db.put(key, value)
+}
+
+func (db *DB) put(key int64, value map[string]float64) error {
+	tm := db.newTime(key)
 
 	c := db.Cursor()
 	c.stack = c.stack[:0]
 
 	// Move cursor to correct position.
-	c.fix(&tm, db.root)
+	if err := c.fix(&tm, db.root); err != nil {
+		return err
+	}
 
 	return c.node().put(&tm, value)
 }
 
-func (db *DB) Delete(from int64, to int64) {
-	fromTime := NewTime(from)
-	toTime := NewTime(to)
+// Delete removes the points in [from, to).
+func (db *DB) Delete(from int64, to int64) error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
 
-	empty := db.root.clean(&fromTime, &toTime)
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	if err := db.wal.delete(from, to); err != nil {
+		return err
+	}
+	return db.delete(from, to)
+}
+
+func (db *DB) delete(from int64, to int64) error {
+	fromTime := db.newTime(from)
+	toTime := db.newTime(to)
+
+	empty, err := db.root.clean(&fromTime, &toTime)
+	if err != nil {
+		return err
+	}
 	if empty {
 		db.root.isLeaf = true
+		db.root.dirty = -1
+		db.root.pointers = make([]*nodePointer, 0)
+		db.root.points = make([]*Point, 0)
+		return nil
 	}
+	db.root.reduce()
+	return nil
 }
 
 func (db *DB) Cursor() *Cursor {
@@ -169,56 +420,159 @@ func (db *DB) Cursor() *Cursor {
 }
 
 func (db *DB) Flush() error {
-	// Flush root, save to meta.
-	db.meta.root = db.root.flush()
-	err := db.writeMeta(db.meta)
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	return db.flush()
+}
+
+func (db *DB) flush() error {
+	// Flush root, the chunks must be on disk before the meta refers to them.
+	// If any of them fails, the meta and the write-ahead log are kept, and
+	// the changes stay in memory.
+	m := &meta{}
+	db.meta.copy(m)
+	m.txid++
+	root, err := db.root.flush()
+	if err != nil {
+		return err
+	}
+	m.root = root
+	err = db.ops.Sync()
 	if err != nil {
 		return err
 	}
 
+	// Save to meta.
+	err = db.writeMeta(m)
+	if err != nil {
+		return err
+	}
 	err = db.ops.Sync()
 	if err != nil {
 		return err
 	}
+	db.meta = m
 
-	return nil
+	// The tree is on disk, the logged changes are not needed anymore.
+	return db.wal.checkpoint()
+}
+
+// DirtyBytes returns the size of the changes logged since the last Flush.
+func (db *DB) DirtyBytes() int64 {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	if !db.opened || db.readOnly {
+		return 0
+	}
+	return db.wal.size()
+}
+
+// Opened reports whether the database is open. A database is closed by Close,
+// or by a Vacuum which cannot load the new file.
+func (db *DB) Opened() bool {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	return db.opened
 }
 
+// Close flushes the changes which are not on disk yet and releases the files
+// of the database. Closing a closed database does nothing.
 func (db *DB) Close() error {
-	db.file = nil
-	db.path = ""
-	return nil
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+
+	if !db.opened {
+		return nil
+	}
+
+	// If the flush fails the changes are still in the write-ahead log, and
+	// are replayed by the next Open.
+	var err error
+	if !db.readOnly && db.wal.size() > 0 {
+		err = db.flush()
+	}
+	if cerr := db.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// close releases the files of the database without flushing it.
+func (db *DB) close() error {
+	db.opened = false
+
+	var err error
+	if db.wal != nil {
+		err = db.wal.close()
+		db.wal = nil
+	}
+	if db.file != nil {
+		// Closing the file releases the lock.
+		if cerr := db.ops.Close(); err == nil {
+			err = cerr
+		}
+		db.file = nil
+	}
+	db.root = nil
+	db.cache.purge(db)
+	return err
 }
 
 const (
 	magic        uint64 = 0xEF5D2BCA
-	Version      uint16 = 1
+	Version      uint16 = 6
 	MetaSize     uint64 = 512
+	MetaSlots    int64  = 2
 	MetaBaseSize uint64 = 3
 	RootBaseSize uint64 = 12
+
+	metaSlotSize = int64(MetaSize) / MetaSlots
 )
 
 type meta struct {
-	magic   uint64
-	version uint16
-	root    int64
+	magic    uint64
+	version  uint16
+	txid     uint64
+	root     int64
+	zone     string // time zone the tree is bucketed in
+	checksum uint64
 }
 
-func newMeta() *meta {
+func newMeta(zone string) *meta {
 	m := &meta{}
+	m.magic = magic
 	m.version = Version
 	m.root = int64(MetaSize)
+	m.zone = zone
 	return m
 }
 
-func newMetaFromBytes(data []byte) (*meta, error) {
+func newMetaFromBytes(data []byte) *meta {
 	m := &meta{}
 
 	m.magic = decodeUint64(data[:8])
 	m.version = decodeUint16(data[8:10])
-	m.root = decodeInt64(data[10:])
+	m.txid = decodeUint64(data[10:18])
+	m.root = decodeInt64(data[18:26])
+
+	// A zone which does not fit is left empty, the checksum fails then.
+	zoneLength := int(decodeUint16(data[26:28]))
+	if 28+zoneLength+8 > len(data) {
+		return m
+	}
+	m.zone = string(data[28 : 28+zoneLength])
+	m.checksum = decodeUint64(data[28+zoneLength : 36+zoneLength])
 
-	return m, nil
+	return m
 }
 
 func (m *meta) toBytes() []byte {
@@ -226,17 +580,34 @@ func (m *meta) toBytes() []byte {
 
 	buf.Write(encodeUint64(m.magic))
 	buf.Write(encodeUint16(m.version))
+	buf.Write(encodeUint64(m.txid))
 	buf.Write(encodeInt64(m.root))
+	buf.Write(encodeUint16(uint16(len(m.zone))))
+	buf.WriteString(m.zone)
+	buf.Write(encodeUint64(m.sum64()))
 
 	return buf.Bytes()
 }
 
+// sum64 generates the checksum of the meta fields.
+func (m *meta) sum64() uint64 {
+	h := fnv.New64a()
+	h.Write(encodeUint64(m.magic))
+	h.Write(encodeUint16(m.version))
+	h.Write(encodeUint64(m.txid))
+	h.Write(encodeInt64(m.root))
+	h.Write([]byte(m.zone))
+	return h.Sum64()
+}
+
 // validate checks the marker bytes and version of the meta page to ensure it matches this binary.
 func (m *meta) validate() error {
 	if m.magic != magic {
 		return ErrInvalid
 	} else if m.version != Version {
 		return ErrVersionMismatch
+	} else if m.checksum != m.sum64() {
+		return ErrChecksum
 	}
 	return nil
 }
@@ -249,6 +620,7 @@ func (m *meta) copy(dest *meta) {
 // Quick operations for database file.
 type Ops struct {
 	File *os.File
+	data []byte // read-only mapping of File, if any
 }
 
 func (o *Ops) OpenFile(path string, flag int, perm os.FileMode) (*os.File, error) {
@@ -258,6 +630,16 @@ func (o *Ops) OpenFile(path string, flag int, perm os.FileMode) (*os.File, error
 }
 
 func (o *Ops) ReadAt(b []byte, off int64) (n int, err error) {
+	if o.data != nil {
+		if off >= int64(len(o.data)) {
+			return 0, io.EOF
+		}
+		n = copy(b, o.data[off:])
+		if n < len(b) {
+			err = io.EOF
+		}
+		return n, err
+	}
 	return o.File.ReadAt(b, off)
 }
 
@@ -273,6 +655,20 @@ func (o *Ops) Sync() error {
 	return o.File.Sync()
 }
 
+func (o *Ops) Truncate(size int64) error {
+	return o.File.Truncate(size)
+}
+
+func (o *Ops) Close() error {
+	if o.data != nil {
+		if err := munmap(o.data); err != nil {
+			return err
+		}
+		o.data = nil
+	}
+	return o.File.Close()
+}
+
 // _assert will panic with a given formatted message if the given condition is false.
 func _assert(condition bool, msg string, v ...interface{}) {
 	if !condition {
@@ -1,14 +1,31 @@
 package storage
 
 import (
+	"bytes"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
 
+// crash releases the files and locks of the databases without flushing them,
+// as a crash of the process would.
+func crash(t *testing.T, dbs ...*DB) {
+	for _, db := range dbs {
+		if err := db.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 func TestOpen(t *testing.T) {
-	path := "/tmp/t"
-	db, err := Open(path, 0600)
+	path := filepath.Join(t.TempDir(), "t")
+	db, err := Open(path, &Options{Mode: 0600})
 	if err != nil {
 		t.Fatal(err)
 	} else if db == nil {
@@ -25,8 +42,8 @@ func TestOpen(t *testing.T) {
 }
 
 func Test_Update(t *testing.T) {
-	path := "/tmp/t"
-	db, _ := Open(path, 0600)
+	path := filepath.Join(t.TempDir(), "t")
+	db, _ := Open(path, nil)
 
 	k := time.Now().UnixNano()
 	v := map[string]float64{
@@ -45,3 +62,429 @@ func Test_Update(t *testing.T) {
 		log.Fatal(err)
 	}
 }
+
+func TestOpenTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(path, &Options{Timeout: 100 * time.Millisecond}); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if _, err := Open(path, &Options{Timeout: 100 * time.Millisecond, ReadOnly: true}); err != ErrTimeout {
+		t.Fatalf("read-only: expected ErrTimeout, got %v", err)
+	}
+
+	// The lock is released by Close.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, &Options{Timeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ro")
+	if _, err := Open(path, &Options{ReadOnly: true}); !os.IsNotExist(err) {
+		t.Fatalf("expected a missing file, got %v", err)
+	}
+
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := time.Date(2016, 8, 28, 21, 24, 0, 0, time.UTC).UnixNano()
+	if err := db.Put(k, map[string]float64{"price": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(k+1, map[string]float64{"price": 2}); err != nil {
+		t.Fatal(err)
+	}
+	// The logged changes are in several branches of the tree.
+	days := func(i int) int64 {
+		return k + int64(i)*int64(40*24*time.Hour)
+	}
+	for i := 1; i <= 5; i++ {
+		if err := db.Put(days(i), map[string]float64{"price": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete(days(3), days(3)+1); err != nil {
+		t.Fatal(err)
+	}
+	crash(t, db)
+
+	// Readers share the lock, and see the logged changes too.
+	options := &Options{ReadOnly: true, Timeout: 100 * time.Millisecond}
+	r1, err := Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r1.Close()
+	r2, err := Open(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.Close()
+
+	for _, r := range []*DB{r1, r2} {
+		if _, err := r.Get(k); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Get(k + 1); err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= 5; i++ {
+			if _, err := r.Get(days(i)); i == 3 && err != ErrNotFound || i != 3 && err != nil {
+				t.Fatalf("point %d: %v", i, err)
+			}
+		}
+		if err := r.Put(k, map[string]float64{"price": 3}); err != ErrDatabaseReadOnly {
+			t.Fatalf("put: expected ErrDatabaseReadOnly, got %v", err)
+		}
+		if err := r.Delete(k, k+1); err != ErrDatabaseReadOnly {
+			t.Fatalf("delete: expected ErrDatabaseReadOnly, got %v", err)
+		}
+		if err := r.Flush(); err != ErrDatabaseReadOnly {
+			t.Fatalf("flush: expected ErrDatabaseReadOnly, got %v", err)
+		}
+	}
+	if _, err := Open(path, &Options{Timeout: 100 * time.Millisecond}); err != ErrTimeout {
+		t.Fatalf("writer: expected ErrTimeout, got %v", err)
+	}
+}
+
+func TestReadOnlySnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	for i := 0; i < 500; i++ {
+		if err := db.Put(base+int64(i)*int64(17*time.Hour), map[string]float64{"price": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if i%100 == 99 {
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	reducer := map[string]string{"price": "sum"}
+	want, err := db.Query(base, base+int64(500*17*time.Hour), Group{Level: LevelMonth}, reducer, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(want) == 0 {
+		t.Fatal("expected query results")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if runtime.GOOS != "windows" && runtime.GOOS != "plan9" && db.ops.data == nil {
+		t.Fatal("expected the file to be mapped")
+	}
+
+	got, err := db.Query(base, base+int64(500*17*time.Hour), Group{Level: LevelMonth}, reducer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("snapshot and writer query results differ")
+	}
+	for i := 0; i < 500; i++ {
+		p, err := db.Get(base + int64(i)*int64(17*time.Hour))
+		if err != nil {
+			t.Fatalf("point %d: %v", i, err)
+		}
+		if p.Value["price"] != float64(i) {
+			t.Fatalf("point %d: unexpected value %v", i, p.Value)
+		}
+	}
+	if _, _, err := db.Vacuum(); err != ErrDatabaseReadOnly {
+		t.Fatalf("vacuum: expected ErrDatabaseReadOnly, got %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "close")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := time.Date(2016, 8, 28, 21, 24, 0, 0, time.UTC).UnixNano()
+	if err := db.Put(k, map[string]float64{"price": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+	if db.Opened() {
+		t.Fatal("expected a closed database")
+	}
+
+	if err := db.Put(k, map[string]float64{"price": 2}); err != ErrDatabaseNotOpen {
+		t.Fatalf("put: expected ErrDatabaseNotOpen, got %v", err)
+	}
+	if _, err := db.Get(k); err != ErrDatabaseNotOpen {
+		t.Fatalf("get: expected ErrDatabaseNotOpen, got %v", err)
+	}
+	if _, err := db.Query(k, k+1, Group{Level: LevelHour}, nil, nil); err != ErrDatabaseNotOpen {
+		t.Fatalf("query: expected ErrDatabaseNotOpen, got %v", err)
+	}
+	if err := db.Delete(k, k+1); err != ErrDatabaseNotOpen {
+		t.Fatalf("delete: expected ErrDatabaseNotOpen, got %v", err)
+	}
+
+	// Close flushed the point, the log is empty.
+	if fi, err := os.Stat(path + WALSuffix); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != 0 {
+		t.Fatalf("expected empty log after close, got %d bytes", fi.Size())
+	}
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if p, err := db.Get(k); err != nil {
+		t.Fatal(err)
+	} else if p.Value["price"] != 1 {
+		t.Fatalf("unexpected value %v", p.Value)
+	}
+}
+
+func TestFlushWriteError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flush")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 100; i++ {
+		k := base.Add(time.Duration(i) * time.Minute).UnixNano()
+		if err := db.Put(k, map[string]float64{"price": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := func(db *DB) {
+		t.Helper()
+		points, err := db.Query(base.UnixNano(), base.Add(24*time.Hour).UnixNano(), Group{Level: LevelDay}, map[string]string{"price": "count"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != 1 || points[0].Value["price"] != 100 {
+			t.Fatalf("expected 100 points, got %v", points)
+		}
+	}
+
+	// The chunks cannot be written to a file opened read-only.
+	file := db.ops.File
+	db.ops.File, err = os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta := *db.meta
+	if err := db.Flush(); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+	db.ops.File.Close()
+	db.ops.File = file
+	if *db.meta != meta {
+		t.Fatalf("expected the meta to be kept, got %+v", db.meta)
+	}
+	if db.DirtyBytes() == 0 {
+		t.Fatal("expected the log to be kept")
+	}
+	// The nodes which were not written are still in memory.
+	count(db)
+
+	// Nothing was lost, the next flush writes the points.
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	count(db)
+}
+
+func TestOpenTornMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "meta")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := time.Date(2016, 8, 28, 21, 24, 0, 0, time.UTC).UnixNano()
+	if err := db.Put(k, map[string]float64{"foo": 1.1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(k+int64(time.Second), map[string]float64{"foo": 1.2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	slot := int64(db.meta.txid%uint64(MetaSlots)) * metaSlotSize
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tear the meta of the last flush.
+	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xff, 0xff}, slot+20)
+	f.Close()
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get(k); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(k + int64(time.Second)); err != ErrNotFound {
+		t.Fatalf("expected the previous meta to be used, got %v", err)
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invalid")
+	if err := ioutil.WriteFile(path, bytes.Repeat([]byte("tickdb"), 200), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, nil); err != ErrInvalid {
+		t.Fatalf("expected ErrInvalid, got %v", err)
+	}
+}
+
+func TestOpenVersionMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "version")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &meta{}
+	db.meta.copy(m)
+	db.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.version = Version + 1
+	for slot := int64(0); slot < MetaSlots; slot++ {
+		f.WriteAt(m.toBytes(), slot*metaSlotSize)
+	}
+	f.Close()
+
+	if _, err := Open(path, nil); err != ErrVersionMismatch {
+		t.Fatalf("expected ErrVersionMismatch, got %v", err)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "concurrent")
+	db, err := Open(path, &Options{SyncPolicy: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const writers, puts = 8, 100
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC).UnixNano()
+	key := func(w, i int) int64 {
+		return base + int64(i*writers+w)*int64(time.Second)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < puts; i++ {
+				if err := db.Put(key(w, i), map[string]float64{"price": float64(i)}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func(r int) {
+			defer readers.Done()
+			for i := 0; i < puts; i++ {
+				if r%2 == 0 {
+					db.Query(base, base+int64(24*time.Hour), Group{Level: LevelHour}, map[string]string{"price": "avg"}, nil)
+				} else if p, err := db.Get(key(r, 0)); err == nil {
+					p.Value["price"] = -1
+				}
+			}
+		}(r)
+	}
+
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+				if err := db.Flush(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	for w := 0; w < writers; w++ {
+		for i := 0; i < puts; i++ {
+			p, err := db.Get(key(w, i))
+			if err != nil {
+				t.Fatalf("writer %d point %d: %v", w, i, err)
+			}
+			if p.Value["price"] != float64(i) {
+				t.Fatalf("writer %d point %d: unexpected value %v", w, i, p.Value)
+			}
+		}
+	}
+}
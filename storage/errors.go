@@ -9,6 +9,10 @@ var (
 	// is opened or after it is closed.
 	ErrDatabaseNotOpen = errors.New("database not open")
 
+	// ErrDatabaseReadOnly is returned when a change is made to a database
+	// opened with Options.ReadOnly.
+	ErrDatabaseReadOnly = errors.New("database is in read-only mode")
+
 	// ErrNotFound is returned when key is not exists.
 	ErrNotFound = errors.New("key not found")
 
@@ -29,4 +33,39 @@ var (
 	ErrChunkBadCrc = errors.New("chunk crc bad")
 
 	ErrChunkDataLessThanSize = errors.New("chunk data less than size")
+
+	// ErrLogCorrupted is returned when a write-ahead log record cannot be decoded.
+	ErrLogCorrupted = errors.New("write-ahead log corrupted")
+
+	// ErrTooManyBuckets is returned when a query returning the empty buckets
+	// would return more than MaxBuckets buckets.
+	ErrTooManyBuckets = errors.New("too many buckets")
+
+	// ErrInvalidGroup is returned when a query has a group whose level is
+	// none of the levels of groups.
+	ErrInvalidGroup = errors.New("invalid group")
+
+	// ErrInvalidFilter is returned when a query has a filter which is none
+	// of the kinds of a Filter.
+	ErrInvalidFilter = errors.New("invalid filter")
+
+	// ErrInvalidWindow is returned when a query has a window whose options
+	// do not fit its function.
+	ErrInvalidWindow = errors.New("invalid window")
+
+	// ErrInvalidLimit is returned when a query has a negative limit or
+	// offset.
+	ErrInvalidLimit = errors.New("invalid limit")
+
+	// ErrTxClosed is returned when committing or rolling back a transaction
+	// that has already been committed or rolled back.
+	ErrTxClosed = errors.New("tx closed")
+
+	// ErrTxLogRequired is returned when a write-ahead log holds a transaction
+	// spanning several databases, but no TxLog was passed to Open().
+	ErrTxLogRequired = errors.New("transaction log required")
+
+	// ErrTxLogMismatch is returned when a transaction spans a database which
+	// was not opened with its TxLog.
+	ErrTxLogMismatch = errors.New("database not opened with the transaction log")
 )
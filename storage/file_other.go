@@ -0,0 +1,24 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package storage
+
+import (
+	"os"
+	"time"
+)
+
+// flock does nothing on platforms without flock(2), the files are not
+// protected against other processes there.
+func flock(f *os.File, exclusive bool, timeout time.Duration) error {
+	return nil
+}
+
+// mmap is not supported, read-only databases fall back to reading the file.
+func mmap(f *os.File, size int64) ([]byte, error) {
+	return nil, nil
+}
+
+func munmap(data []byte) error {
+	return nil
+}
@@ -0,0 +1,50 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package storage
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// flockRetry is the pause between two attempts to take a lock.
+const flockRetry = 50 * time.Millisecond
+
+// flock acquires an advisory lock on f. An exclusive lock is taken for
+// writing, a shared one for reading. A zero timeout waits forever.
+func flock(f *os.File, exclusive bool, timeout time.Duration) error {
+	var t time.Time
+	if timeout != 0 {
+		t = time.Now()
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		} else if err != syscall.EWOULDBLOCK {
+			return err
+		}
+
+		// Wait and try again until the timeout is exceeded.
+		if timeout != 0 && time.Since(t) > timeout-flockRetry {
+			return ErrTimeout
+		}
+		time.Sleep(flockRetry)
+	}
+}
+
+// mmap maps the first size bytes of f read-only into memory.
+func mmap(f *os.File, size int64) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmap unmaps a mapping returned by mmap.
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,268 @@
+package storage
+
+import "strings"
+
+// MaxBuckets bounds the buckets returned by a query which returns the empty
+// buckets too.
+const MaxBuckets = 1 << 20
+
+// FillPolicy is how a query returns the buckets without points.
+type FillPolicy int
+
+const (
+	// FillNone leaves the empty buckets out.
+	FillNone FillPolicy = iota
+
+	// FillNull returns the empty buckets without fields.
+	FillNull
+
+	// FillPrevious repeats every field of the last bucket with it, which
+	// may be before the queried range.
+	FillPrevious
+
+	// FillLinear interpolates every field between the buckets with it
+	// around, which may be the closest ones outside of the queried range.
+	// Without a bucket with the field on both sides, it is left out.
+	FillLinear
+
+	// FillConstant returns the fields with QueryOptions.FillValue.
+	FillConstant
+)
+
+// fill returns the buckets of points together with the empty buckets
+// between from and to, filled as options tell.
+func (db *DB) fill(points []*Point, from int64, to int64, group Group, reducer map[string]string, options *QueryOptions) ([]*Point, error) {
+	loc := group.Location
+	var result []*Point
+	var empty []bool
+	for key := group.start(from, loc); key < to; key = group.next(key, loc) {
+		if len(result) >= MaxBuckets {
+			return nil, ErrTooManyBuckets
+		}
+		if len(points) > 0 && points[0].Timestamp == key {
+			result = append(result, points[0])
+			empty = append(empty, false)
+			points = points[1:]
+			continue
+		}
+		result = append(result, &Point{Timestamp: key, Value: make(map[string]float64)})
+		empty = append(empty, true)
+	}
+	if len(result) == 0 {
+		return result, nil
+	}
+
+	// With Wildcard, every field of the database is filled, not only the
+	// ones in the buckets, which may be narrowed by a limit.
+	var names map[string]bool
+	if _, ok := reducer[Wildcard]; ok {
+		names = make(map[string]bool)
+		db.root.fields(names)
+	}
+	fields := filledFields(reducer, names)
+	switch options.Fill {
+	case FillConstant:
+		for i, p := range result {
+			if empty[i] {
+				for name := range fields {
+					p.Value[name] = options.FillValue
+				}
+			}
+		}
+
+	case FillPrevious, FillLinear:
+		// The buckets around are the closest ones with the field, which may
+		// be further than the closest ones with points.
+		near := make(map[string][2]*Point)
+		for name, field := range fields {
+			around, ok := near[field]
+			if !ok {
+				var err error
+				around[0], err = db.fieldNear(result[0].Timestamp, false, field, group, reducer, options.Filter)
+				if err != nil {
+					return nil, err
+				}
+				if options.Fill == FillLinear {
+					around[1], err = db.fieldNear(group.next(result[len(result)-1].Timestamp, loc), true, field, group, reducer, options.Filter)
+					if err != nil {
+						return nil, err
+					}
+				}
+				near[field] = around
+			}
+			if options.Fill == FillPrevious {
+				fillPrevious(result, empty, name, around[0])
+			} else {
+				fillLinear(result, empty, name, around[0], around[1])
+			}
+		}
+	}
+	return result, nil
+}
+
+// fillPrevious sets the field name of the empty buckets to the one of the
+// bucket with it before them, the first of which may be before.
+func fillPrevious(points []*Point, empty []bool, name string, before *Point) {
+	v, ok := before.Value[name]
+	for i, p := range points {
+		if !empty[i] {
+			if f, has := p.Value[name]; has {
+				v, ok = f, true
+			}
+		} else if ok {
+			p.Value[name] = v
+		}
+	}
+}
+
+// fillLinear sets the field name of the empty buckets to the interpolation
+// between the buckets with it around them, which may be before and after.
+func fillLinear(points []*Point, empty []bool, name string, before *Point, after *Point) {
+	// The buckets with the field, the empty ones are between them.
+	var known []*Point
+	if _, ok := before.Value[name]; ok {
+		known = append(known, before)
+	}
+	for i, p := range points {
+		if _, ok := p.Value[name]; ok && !empty[i] {
+			known = append(known, p)
+		}
+	}
+	if _, ok := after.Value[name]; ok {
+		known = append(known, after)
+	}
+
+	k := 0
+	for i, p := range points {
+		for k < len(known) && known[k].Timestamp <= p.Timestamp {
+			k++
+		}
+		if !empty[i] || k == 0 || k == len(known) {
+			continue
+		}
+		p0, p1 := known[k-1], known[k]
+		v0, v1 := p0.Value[name], p1.Value[name]
+		p.Value[name] = v0 + (v1-v0)*float64(p.Timestamp-p0.Timestamp)/float64(p1.Timestamp-p0.Timestamp)
+	}
+}
+
+// filledFields returns the fields empty buckets are filled with, and the
+// field of the points each of them is reduced from: the ones reduced from
+// the fields named in reducer, and with Wildcard from the other ones in
+// names.
+func filledFields(reducer map[string]string, names map[string]bool) map[string]string {
+	fields := make(map[string]string)
+	for field, r := range reducer {
+		if field == Wildcard {
+			continue
+		}
+		for name, r := range reducedFields(field, r) {
+			if KnownReducer(r) {
+				fields[name] = field
+			}
+		}
+	}
+	if r, ok := reducer[Wildcard]; ok {
+		for field := range names {
+			if _, named := reducer[field]; named {
+				continue
+			}
+			for name, r := range reducedFields(field, r) {
+				if KnownReducer(r) {
+					fields[name] = field
+				}
+			}
+		}
+	}
+	return fields
+}
+
+// wildcardField returns the field of the points a field of a bucket named
+// name is reduced from by one of reducers of Wildcard.
+func wildcardField(name string, reducers []string) string {
+	if len(reducers) == 1 {
+		return name
+	}
+	for _, r := range reducers {
+		if strings.HasSuffix(name, "."+r) {
+			return strings.TrimSuffix(name, "."+r)
+		}
+	}
+	return name
+}
+
+// fieldNear returns the closest bucket of group with the field before ts, or
+// from ts on if after is true, of the points selected by filter. Without
+// such a bucket, the point returned has no fields.
+func (db *DB) fieldNear(ts int64, after bool, field string, group Group, reducer map[string]string, filter *Filter) (*Point, error) {
+	c := db.groupCursor(ts, group.next(ts, group.Location), group, filter)
+	var ok bool
+	var err error
+	if after {
+		ok, err = c.seek(ts)
+	} else {
+		ok, err = c.seekBefore(ts)
+	}
+	for ok && err == nil {
+		// The closest point of the field in the element is the first or
+		// the last one.
+		v := elementValue(c)
+		if agg, has := v[field]; has && (filter == nil || filter.match(v)) {
+			if after && agg.firstTime >= ts {
+				return db.bucketAt(group.start(agg.firstTime, group.Location), group, reducer, filter)
+			}
+			if !after && agg.lastTime < ts {
+				return db.bucketAt(group.start(agg.lastTime, group.Location), group, reducer, filter)
+			}
+		}
+		if after {
+			ok, err = c.next()
+		} else {
+			ok, err = c.prev()
+		}
+	}
+	return &Point{Value: map[string]float64{}}, err
+}
+
+// bucketAt returns the bucket of group starting at key, of the points
+// selected by filter.
+func (db *DB) bucketAt(key int64, group Group, reducer map[string]string, filter *Filter) (*Point, error) {
+	p := &Point{Timestamp: key, Value: map[string]float64{}}
+	err := db.aggregate(key, group.next(key, group.Location), group, filter, func(key int64, value map[string]Value) bool {
+		p = reducePoint(key, value, reducer)
+		return true
+	})
+	return p, err
+}
+
+// pointNear returns the time of the closest point selected by filter before
+// ts, or from ts on if after is true, false if there is none.
+func (db *DB) pointNear(ts int64, after bool, filter *Filter) (int64, bool, error) {
+	c := db.Cursor()
+	c.level = LevelNSecond
+	var ok bool
+	var err error
+	if after {
+		ok, err = c.seek(ts)
+	} else {
+		ok, err = c.seekBefore(ts)
+	}
+	for ok && err == nil && filter != nil && !filter.match(elementValue(c)) {
+		if after {
+			ok, err = c.next()
+		} else {
+			ok, err = c.prev()
+		}
+	}
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	k, _ := c.element()
+	return k, true, nil
+}
+
+// elementValue returns the aggregates of the element of c.
+func elementValue(c *Cursor) map[string]Value {
+	_, v := c.element()
+	return v
+}
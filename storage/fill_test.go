@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueryFill(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "fill"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC)
+	hours := func(h int) int64 {
+		return base.Add(time.Duration(h) * time.Hour).UnixNano()
+	}
+	for _, h := range []int{0, 1, 4, 8, 14} {
+		if err := db.Put(hours(h), map[string]float64{"price": float64(10 * h)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reducer := map[string]string{"price": "sum"}
+
+	// nan stands for a bucket without the field.
+	nan := math.NaN()
+	tests := []struct {
+		group   Group
+		from    int
+		to      int
+		options *QueryOptions
+		want    []float64
+	}{
+		{Group{Level: LevelHour}, 2, 12, nil, []float64{40, 80}},
+		{Group{Level: LevelHour}, 2, 12, &QueryOptions{Fill: FillNull}, []float64{nan, nan, 40, nan, nan, nan, 80, nan, nan, nan}},
+		{Group{Level: LevelHour}, 2, 12, &QueryOptions{Fill: FillConstant, FillValue: -1}, []float64{-1, -1, 40, -1, -1, -1, 80, -1, -1, -1}},
+		{Group{Level: LevelHour}, 2, 12, &QueryOptions{Fill: FillPrevious}, []float64{10, 10, 40, 40, 40, 40, 80, 80, 80, 80}},
+		{Group{Level: LevelHour}, 2, 12, &QueryOptions{Fill: FillLinear}, []float64{20, 30, 40, 50, 60, 70, 80, 90, 100, 110}},
+		{Group{Level: LevelHour, Count: 2}, 0, 12, &QueryOptions{Fill: FillLinear}, []float64{10, 25, 40, 60, 80, 100}},
+		{Group{Level: LevelHour, Count: 2}, 0, 24, &QueryOptions{Fill: FillLinear}, []float64{10, 25, 40, 60, 80, 100, 120, 140, nan, nan, nan, nan}},
+		{Group{Level: LevelHour}, -3, 2, &QueryOptions{Fill: FillPrevious}, []float64{nan, nan, nan, 0, 10}},
+		{Group{Level: LevelDay}, -48, 72, &QueryOptions{Fill: FillNull}, []float64{nan, nan, 270, nan, nan}},
+	}
+	for _, test := range tests {
+		points, err := db.Query(hours(test.from), hours(test.to), test.group, reducer, test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != len(test.want) {
+			t.Fatalf("%+v from %d: expected %d buckets, got %d", test.options, test.from, len(test.want), len(points))
+		}
+		for i, want := range test.want {
+			v, ok := points[i].Value["price"]
+			if math.IsNaN(want) && ok || !math.IsNaN(want) && (!ok || math.Abs(v-want) > 1e-9) {
+				t.Fatalf("%+v from %d, bucket %d: expected %v, got %v", test.options, test.from, i, want, points[i].Value)
+			}
+		}
+		if test.options != nil && test.options.Fill != FillNone {
+			key := test.group.start(hours(test.from), time.UTC)
+			for _, p := range points {
+				if p.Timestamp != key {
+					t.Fatalf("expected bucket %v, got %v", time.Unix(0, key).UTC(), time.Unix(0, p.Timestamp).UTC())
+				}
+				key = test.group.next(key, time.UTC)
+			}
+		}
+	}
+
+	_, err = db.Query(hours(0), hours(1), Group{Level: LevelNSecond}, reducer, &QueryOptions{Fill: FillNull})
+	if err != ErrTooManyBuckets {
+		t.Fatalf("expected ErrTooManyBuckets, got %v", err)
+	}
+}
+
+func TestQueryFillFields(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "fill"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC)
+	hours := func(h int) int64 {
+		return base.Add(time.Duration(h) * time.Hour).UnixNano()
+	}
+	for h, value := range map[int]map[string]float64{
+		0:  {"price": 0, "volume": 10},
+		2:  {"price": 20},
+		6:  {"price": 60},
+		10: {"price": 100, "volume": 50},
+	} {
+		if err := db.Put(hours(h), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The closest buckets around have no volume, it is filled from the
+	// buckets with it.
+	tests := []struct {
+		reducer map[string]string
+		options *QueryOptions
+		want    map[string][]float64
+	}{
+		{map[string]string{"price": "sum", "volume": "sum"}, &QueryOptions{Fill: FillPrevious}, map[string][]float64{
+			"price":  {20, 20, 20},
+			"volume": {10, 10, 10},
+		}},
+		{map[string]string{"price": "sum", "volume": "sum"}, &QueryOptions{Fill: FillLinear}, map[string][]float64{
+			"price":  {30, 40, 50},
+			"volume": {22, 26, 30},
+		}},
+		{map[string]string{Wildcard: "sum"}, &QueryOptions{Fill: FillLinear}, map[string][]float64{
+			"price":  {30, 40, 50},
+			"volume": {22, 26, 30},
+		}},
+		{map[string]string{Wildcard: "sum,max"}, &QueryOptions{Fill: FillPrevious, Filter: &Filter{Exists: "price"}}, map[string][]float64{
+			"price.sum":  {20, 20, 20},
+			"price.max":  {20, 20, 20},
+			"volume.sum": {10, 10, 10},
+			"volume.max": {10, 10, 10},
+		}},
+	}
+	for _, test := range tests {
+		points, err := db.Query(hours(3), hours(6), Group{Level: LevelHour}, test.reducer, test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != 3 {
+			t.Fatalf("%v %+v: expected 3 buckets, got %d", test.reducer, test.options, len(points))
+		}
+		for i, p := range points {
+			if len(p.Value) != len(test.want) {
+				t.Fatalf("%v %+v, bucket %d: expected %v, got %v", test.reducer, test.options, i, test.want, p.Value)
+			}
+			for name, want := range test.want {
+				if v, ok := p.Value[name]; !ok || math.Abs(v-want[i]) > 1e-9 {
+					t.Fatalf("%v %+v, bucket %d: expected %s %v, got %v", test.reducer, test.options, i, name, want[i], p.Value)
+				}
+			}
+		}
+	}
+}
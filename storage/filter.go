@@ -0,0 +1,106 @@
+package storage
+
+// Filter selects the points of a query by the values of their fields. It is
+// one of: all of And, one of Or, not Not, Exists being a field of the point,
+// or the field Field compared with Value by Op, one of "==", "!=", "<",
+// "<=", ">" and ">=". A comparison of a field the point has not is false.
+type Filter struct {
+	And    []*Filter `json:"and,omitempty"`
+	Or     []*Filter `json:"or,omitempty"`
+	Not    *Filter   `json:"not,omitempty"`
+	Exists string    `json:"exists,omitempty"`
+	Field  string    `json:"field,omitempty"`
+	Op     string    `json:"op,omitempty"`
+	Value  float64   `json:"value"`
+}
+
+// validate returns ErrInvalidFilter unless every filter of f is one of its
+// kinds.
+func (f *Filter) validate() error {
+	if f == nil {
+		return ErrInvalidFilter
+	}
+	kinds := 0
+	if f.And != nil {
+		kinds++
+	}
+	if f.Or != nil {
+		kinds++
+	}
+	if f.Not != nil {
+		kinds++
+	}
+	if f.Exists != "" {
+		kinds++
+	}
+	if f.Field != "" {
+		kinds++
+		switch f.Op {
+		case "==", "!=", "<", "<=", ">", ">=":
+		default:
+			return ErrInvalidFilter
+		}
+	} else if f.Op != "" {
+		return ErrInvalidFilter
+	}
+	if kinds != 1 {
+		return ErrInvalidFilter
+	}
+
+	for _, filters := range [][]*Filter{f.And, f.Or} {
+		for _, sub := range filters {
+			if err := sub.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	if f.Not != nil {
+		return f.Not.validate()
+	}
+	return nil
+}
+
+// match returns whether a point is selected by f, value being the
+// aggregates of the point alone.
+func (f *Filter) match(value map[string]Value) bool {
+	switch {
+	case f.And != nil:
+		for _, sub := range f.And {
+			if !sub.match(value) {
+				return false
+			}
+		}
+		return true
+	case f.Or != nil:
+		for _, sub := range f.Or {
+			if sub.match(value) {
+				return true
+			}
+		}
+		return false
+	case f.Not != nil:
+		return !f.Not.match(value)
+	case f.Exists != "":
+		_, ok := value[f.Exists]
+		return ok
+	}
+
+	agg, ok := value[f.Field]
+	if !ok {
+		return false
+	}
+	v := agg.last
+	switch f.Op {
+	case "==":
+		return v == f.Value
+	case "!=":
+		return v != f.Value
+	case "<":
+		return v < f.Value
+	case "<=":
+		return v <= f.Value
+	case ">":
+		return v > f.Value
+	}
+	return v >= f.Value
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueryFilter(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "filter"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	r := rand.New(rand.NewSource(1))
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC)
+	var points []Point
+	for i := 0; i < 2000; i++ {
+		ts := base.Add(time.Duration(r.Int63n(int64(48 * time.Hour)))).UnixNano()
+		value := map[string]float64{"price": float64(r.Intn(100))}
+		if r.Intn(3) != 0 {
+			value["volume"] = float64(r.Intn(2000))
+		}
+		points = append(points, Point{Timestamp: ts, Value: value})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+	// The last point of a timestamp is kept.
+	latest := make(map[int64]map[string]float64)
+	for _, p := range points {
+		latest[p.Timestamp] = p.Value
+	}
+
+	filters := []*Filter{
+		{Field: "volume", Op: ">", Value: 1000},
+		{Field: "price", Op: "<=", Value: 10},
+		{Field: "price", Op: "==", Value: 42},
+		{Not: &Filter{Exists: "volume"}},
+		{Or: []*Filter{
+			{And: []*Filter{{Field: "price", Op: ">=", Value: 50}, {Field: "volume", Op: "<", Value: 100}}},
+			{Field: "price", Op: "!=", Value: 1},
+		}},
+	}
+	from, to := base.UnixNano(), base.Add(48*time.Hour).UnixNano()
+	group := Group{Level: LevelHour, Location: time.UTC}
+	for _, filter := range filters {
+		prices := make(map[int64]float64)
+		for ts, value := range latest {
+			if filterMatch(filter, value) {
+				prices[ts] = value["price"]
+			}
+		}
+		want := bruteQuery(prices, from, to, group)
+		if got := queryFields(t, db, from, to, group, filter); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%+v: expected %v, got %v", filter, want, got)
+		}
+	}
+
+	invalid := []*Filter{
+		{},
+		{Field: "price", Op: "~", Value: 1},
+		{Field: "price", Exists: "price"},
+		{And: []*Filter{{Op: ">"}}},
+		{Not: &Filter{}},
+	}
+	for _, filter := range invalid {
+		_, err := db.Query(from, to, group, map[string]string{"price": "sum"}, &QueryOptions{Filter: filter})
+		if err != ErrInvalidFilter {
+			t.Fatalf("%+v: expected ErrInvalidFilter, got %v", filter, err)
+		}
+	}
+}
+
+func TestQueryFilterFill(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "filter"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC)
+	hours := func(h int) int64 {
+		return base.Add(time.Duration(h) * time.Hour).UnixNano()
+	}
+	for h, value := range map[int]map[string]float64{
+		0: {"price": 1, "volume": 2000},
+		1: {"price": 2, "volume": 10},
+		3: {"price": 3, "volume": 10},
+		4: {"price": 4, "volume": 3000},
+	} {
+		if err := db.Put(hours(h), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	options := &QueryOptions{
+		Fill:   FillLinear,
+		Filter: &Filter{Field: "volume", Op: ">", Value: 1000},
+	}
+	points, err := db.Query(hours(2), hours(4), Group{Level: LevelHour}, map[string]string{"price": "sum"}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []float64
+	for _, p := range points {
+		got = append(got, p.Value["price"])
+	}
+	if want := []float64{2.5, 3.25}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+// filterMatch returns whether f selects a point with the fields of value.
+func filterMatch(f *Filter, value map[string]float64) bool {
+	aggregates := make(map[string]Value, len(value))
+	for k, v := range value {
+		aggregates[k] = pointValue(0, v)
+	}
+	return f.match(aggregates)
+}
@@ -42,7 +42,19 @@ type Value struct {
 	min   float64
 	first float64
 	last  float64
-	count uint16
+	count uint64
+	m2    float64 // sum of the squared differences to the mean
+
+	// times of the first, last, largest and smallest values. Of equal
+	// extremes, the first one is kept.
+	firstTime int64
+	lastTime  int64
+	maxTime   int64
+	minTime   int64
+
+	// sketch of the values, shared by the copies of Value. It must not be
+	// modified, unless it was cloned.
+	sketch *sketch
 }
 
 type nodePointer struct {
@@ -59,19 +71,40 @@ func (v *Value) encode() []byte {
 	buf.Write(encodeFloat64(v.min))
 	buf.Write(encodeFloat64(v.first))
 	buf.Write(encodeFloat64(v.last))
-	buf.Write(encodeUint16(v.count))
+	buf.Write(encodeUint64(v.count))
+	buf.Write(encodeFloat64(v.m2))
+	buf.Write(encodeInt64(v.firstTime))
+	buf.Write(encodeInt64(v.lastTime))
+	buf.Write(encodeInt64(v.maxTime))
+	buf.Write(encodeInt64(v.minTime))
+	buf.Write(v.sketch.encode())
 	return buf.Bytes()
 }
 
-func decodeValue(valueBytes []byte) Value {
+// decodeValue decodes a value from the beginning of valueBytes, it returns
+// the number of bytes read.
+func decodeValue(valueBytes []byte) (Value, int, error) {
 	v := Value{}
+	if len(valueBytes) < 88 {
+		return v, 0, ErrInvalid
+	}
 	v.sum = decodeFloat64(valueBytes[0:8])
 	v.max = decodeFloat64(valueBytes[8:16])
 	v.min = decodeFloat64(valueBytes[16:24])
 	v.first = decodeFloat64(valueBytes[24:32])
 	v.last = decodeFloat64(valueBytes[32:40])
-	v.count = decodeUint16(valueBytes[40:42])
-	return v
+	v.count = decodeUint64(valueBytes[40:48])
+	v.m2 = decodeFloat64(valueBytes[48:56])
+	v.firstTime = decodeInt64(valueBytes[56:64])
+	v.lastTime = decodeInt64(valueBytes[64:72])
+	v.maxTime = decodeInt64(valueBytes[72:80])
+	v.minTime = decodeInt64(valueBytes[80:88])
+	sketch, n, err := decodeSketch(valueBytes[88:])
+	if err != nil {
+		return v, 0, err
+	}
+	v.sketch = sketch
+	return v, 88 + n, nil
 }
 
 func (np *nodePointer) encode() []byte {
@@ -99,8 +132,11 @@ func decodeNodePointer(npBytes []byte) (*nodePointer, error) {
 		bufPos += 2
 		key := string(npBytes[bufPos : bufPos+keyLength])
 		bufPos += keyLength
-		value := decodeValue(npBytes[bufPos : bufPos+42])
-		bufPos += 42
+		value, n, err := decodeValue(npBytes[bufPos:])
+		if err != nil {
+			return nil, err
+		}
+		bufPos += n
 		np.value[key] = value
 	}
 
@@ -120,7 +156,7 @@ func (n *node) encode() []byte {
 		buf.Write(encodeUint16(n.level | InteriorChunkFlag))
 		for _, pointer := range n.pointers {
 			pointerBytes := pointer.encode()
-			buf.Write(encodeUint16(uint16(len(pointerBytes))))
+			buf.Write(encodeUint32(uint32(len(pointerBytes))))
 			buf.Write(pointerBytes)
 		}
 	}
@@ -159,8 +195,8 @@ func (db *DB) decodeInteriorNode(nodeBytes []byte) (*node, error) {
 
 	bufPos := 2
 	for bufPos < len(nodeBytes) {
-		pointerLength := int(decodeUint16(nodeBytes[bufPos : bufPos+2]))
-		bufPos += 2
+		pointerLength := int(decodeUint32(nodeBytes[bufPos : bufPos+4]))
+		bufPos += 4
 		pointer, err := decodeNodePointer(nodeBytes[bufPos : bufPos+pointerLength])
 		if err != nil {
 			return nil, err
@@ -175,6 +211,7 @@ func (db *DB) newLeafNode() *node {
 	return &node{
 		db:     db,
 		isLeaf: true,
+		dirty:  -1,
 		points: make([]*Point, 0),
 	}
 }
@@ -188,13 +225,18 @@ func (db *DB) newInteriorNode() *node {
 	}
 }
 
-// flush node to disk.
-func (n *node) flush() int64 {
+// flush writes n to disk and returns its position. The children which are
+// not on disk yet are written first; they are dropped from memory only once
+// n is written, so nothing is lost if a write fails.
+func (n *node) flush() (int64, error) {
 	flags := n.level
 	if !n.isLeaf {
-		if n.dirty != -1 {
-			n.pointers[n.dirty].pos = n.pointers[n.dirty].pointer.flush()
-			n.dirty = -1
+		for i, np := range n.pointers {
+			if i == n.dirty || np.pointer != nil && np.pos == 0 {
+				if err := n.flushChild(i); err != nil {
+					return 0, err
+				}
+			}
 		}
 		flags = flags | InteriorChunkFlag
 	} else {
@@ -204,20 +246,40 @@ func (n *node) flush() int64 {
 
 	pos, _, err := n.db.writeChunk(nodeBytes)
 	if err != nil {
-		return int64(0)
+		return 0, err
 	}
 
-	return pos
+	// The children are on disk now, they are read again when needed.
+	if !n.isLeaf {
+		n.dirty = -1
+		for _, np := range n.pointers {
+			np.pointer = nil
+		}
+	}
+	return pos, nil
 }
 
-func (n *node) put(t *Time, value map[string]float64) error {
-	var err error
-	if n.isLeaf {
-		err = n.insertPoint(t, value)
-	} else {
-		err = n.insertNode(t, value)
+// flushChild reduces and writes the child at index, which is in memory. If
+// the write fails, its position is 0 until it is written with n. A read-only
+// database replays its log in memory, the child is only reduced and kept.
+func (n *node) flushChild(index int) error {
+	np := n.pointers[index]
+	np.value = np.pointer.reduce()
+	if n.db.readOnly {
+		np.pos = 0
+		return nil
 	}
+	pos, err := np.pointer.flush()
 	if err != nil {
+		np.pos = 0
+		return err
+	}
+	np.pos = pos
+	return nil
+}
+
+func (n *node) put(t *Time, value map[string]float64) error {
+	if err := n.insert(t, value); err != nil {
 		return err
 	}
 
@@ -225,6 +287,23 @@ func (n *node) put(t *Time, value map[string]float64) error {
 	return nil
 }
 
+// insert adds the point without updating the aggregates of the dirty branch.
+func (n *node) insert(t *Time, value map[string]float64) error {
+	if n.isLeaf {
+		return n.insertPoint(t, value)
+	}
+	return n.insertNode(t, value)
+}
+
+// holds returns whether a point at t belongs into the leaf n, which was
+// reached by fixing a cursor at from.
+func (n *node) holds(from, t *Time) bool {
+	if t.Level()>>1 > n.level {
+		return false
+	}
+	return n.level == LevelRoot || t.Timestamp(n.level) == from.Timestamp(n.level)
+}
+
 func (n *node) insertPoint(t *Time, value map[string]float64) error {
 	index := sort.Search(len(n.points), func(i int) bool {
 		return n.points[i].Timestamp >= t.TS
@@ -299,39 +378,83 @@ func (n *node) insertNode(t *Time, value map[string]float64) error {
 	return nil
 }
 
-// expand leafnode to iterior node
+// expand leafnode to iterior node. The new leaves are written with n.
 func (n *node) expand() {
 	n.isLeaf = false
+	n.dirty = -1
 
 	for _, point := range n.points {
 		leafNode := n.db.newLeafNode()
 		leafNode.level = n.level << 1
+		leafNode.parent = n
 		leafNode.points = append(leafNode.points, point)
 
 		np := nodePointer{
 			key:     point.Timestamp,
-			pos:     leafNode.flush(),
 			pointer: leafNode,
+			value:   leafNode.reduce(),
 		}
 		n.pointers = append(n.pointers, &np)
 	}
+	n.points = nil
+}
+
+// child returns the node behind the pointer at index, it is read from disk if
+// needed. The child is kept until n is flushed, so it can be modified.
+func (n *node) child(index int) (*node, error) {
+	np := n.pointers[index]
+	if np.pointer == nil {
+		// Readers must not see the changes, so the cached copy is dropped.
+		n.db.cache.remove(n.db, np.pos)
+		child, err := n.db.node(np.pos)
+		if err != nil {
+			return nil, err
+		}
+		child.parent = n
+		np.pointer = child
+	}
+	return np.pointer, nil
 }
 
-func (n *node) clean(from, to *Time) bool {
+// load returns the node behind the pointer at index like child does, but a
+// node read from disk is only kept in the cache, so readers never modify
+// the tree.
+func (n *node) load(index int) (*node, error) {
+	np := n.pointers[index]
+	if np.pointer != nil {
+		return np.pointer, nil
+	}
+	return n.db.cachedNode(np.pos)
+}
+
+// flushDirty reduces and flushes the dirty branch, so it is not dirty
+// anymore. If the write fails, the branch stays dirty. A branch which is not
+// on disk stays in memory.
+func (n *node) flushDirty() error {
+	if n.dirty == -1 {
+		return nil
+	}
+	if err := n.flushChild(n.dirty); err != nil {
+		return err
+	}
+	if np := n.pointers[n.dirty]; np.pos != 0 {
+		np.pointer = nil
+	}
+	n.dirty = -1
+	return nil
+}
+
+// clean removes the points in [from, to), returns true if the node is empty.
+func (n *node) clean(from, to *Time) (bool, error) {
 	if n.isLeaf {
-		index := sort.Search(len(n.points), func(i int) bool {
+		fromIndex := sort.Search(len(n.points), func(i int) bool {
 			return n.points[i].Timestamp >= from.TS
 		})
-		for i, point := range n.points[index:] {
-			if point.Timestamp >= to.TS {
-				n.points = append(n.points[:index], n.points[i:]...)
-			}
-			break
-		}
-		if len(n.points) == 0 {
-			return true
-		}
-		return false
+		toIndex := sort.Search(len(n.points), func(i int) bool {
+			return n.points[i].Timestamp >= to.TS
+		})
+		n.points = append(n.points[:fromIndex], n.points[toIndex:]...)
+		return len(n.points) == 0, nil
 	}
 
 	f := from.Timestamp(n.level << 1)
@@ -341,239 +464,212 @@ func (n *node) clean(from, to *Time) bool {
 		index := sort.Search(len(n.pointers), func(i int) bool {
 			return n.pointers[i].key >= f
 		})
-		if n.pointers[index].key == f {
-			if index != n.dirty {
-				if n.dirty != -1 {
-					n.pointers[n.dirty].pos = n.pointers[n.dirty].pointer.flush()
-				}
-				n.dirty = index
-			}
-			if n.pointers[index].pointer == nil {
-				var err error
-				n.pointers[index].pointer, err = n.db.node(n.pointers[index].pos)
-				if err != nil {
-					return true
-				}
-			}
-			if empty := n.pointers[index].pointer.clean(from, to); empty {
-				if len(n.pointers) == 1 {
-					return true
-				}
-				n.pointers = append(n.pointers[:index], n.pointers[index+1:]...)
-				return false
+		if index >= len(n.pointers) || n.pointers[index].key != f {
+			return false, nil
+		}
+		if index != n.dirty {
+			if err := n.flushDirty(); err != nil {
+				return false, err
 			}
 		}
-	} else {
-		n.dirty = -1
-		fromIndex := sort.Search(len(n.pointers), func(i int) bool {
-			return n.pointers[i].key >= f
-		})
-		if n.pointers[fromIndex].key == f {
-			// if from time is the begin of node, drop it directly.
-			if f != from.TS {
-				n.dirty = fromIndex
-				if n.pointers[fromIndex].pointer == nil {
-					var err error
-					n.pointers[fromIndex].pointer, err = n.db.node(n.pointers[fromIndex].pos)
-					if err != nil {
-						return true
-					}
-				}
-				empty := n.pointers[fromIndex].pointer.cleanFrom(from)
-				if !empty {
-					n.pointers[fromIndex].pointer.reduce()
-					n.pointers[fromIndex].pos = n.pointers[fromIndex].pointer.flush()
+		child, err := n.child(index)
+		if err != nil {
+			return false, err
+		}
+		// The child is changed even if cleaning it fails halfway.
+		n.dirty = index
+		empty, err := child.clean(from, to)
+		if err != nil {
+			return false, err
+		}
+		if empty {
+			n.pointers = append(n.pointers[:index], n.pointers[index+1:]...)
+			n.dirty = -1
+			return len(n.pointers) == 0, nil
+		}
+		return false, nil
+	}
 
-					// persist fromIndex
-					fromIndex++
-				}
+	// The branches between from and to are dropped, only the ones holding
+	// from and to are cut.
+	if err := n.flushDirty(); err != nil {
+		return false, err
+	}
+	fromIndex := sort.Search(len(n.pointers), func(i int) bool {
+		return n.pointers[i].key >= f
+	})
+	if fromIndex < len(n.pointers) && n.pointers[fromIndex].key == f && f != from.TS {
+		// if from time is the begin of node, drop it directly.
+		child, err := n.child(fromIndex)
+		if err != nil {
+			return false, err
+		}
+		n.pointers[fromIndex].pos = 0
+		empty, err := child.cleanFrom(from)
+		if err != nil {
+			return false, err
+		}
+		if !empty {
+			if err := n.flushChild(fromIndex); err != nil {
+				return false, err
 			}
+
+			// persist fromIndex
+			fromIndex++
 		}
+	}
 
-		toIndex := fromIndex
-		if n.pointers[len(n.pointers)-1].key < t {
-			n.pointers = n.pointers[:fromIndex]
-		} else {
-			for i, pointer := range n.pointers[toIndex:] {
-				if pointer.key >= t {
-					if pointer.key == t {
-						toIndex = fromIndex + i
-						if t != to.TS {
-							if n.pointers[toIndex].pointer == nil {
-								var err error
-								n.pointers[toIndex].pointer, err = n.db.node(n.pointers[toIndex].pos)
-								if err != nil {
-									return true
-								}
-							}
-							empty := n.pointers[toIndex].pointer.cleanTo(to)
-							if !empty {
-								n.pointers[toIndex].pointer.reduce()
-								n.pointers[toIndex].pos = n.pointers[toIndex].pointer.flush()
-							} else {
-								toIndex++
-							}
-							break
-						}
-					}
-				}
-			}
-			n.pointers = append(n.pointers[:fromIndex], n.pointers[toIndex:]...)
+	toIndex := sort.Search(len(n.pointers), func(i int) bool {
+		return n.pointers[i].key >= t
+	})
+	if toIndex < len(n.pointers) && n.pointers[toIndex].key == t && t != to.TS {
+		child, err := n.child(toIndex)
+		if err != nil {
+			return false, err
 		}
-		if len(n.pointers) == 0 {
-			return true
+		n.pointers[toIndex].pos = 0
+		empty, err := child.cleanTo(to)
+		if err != nil {
+			return false, err
+		}
+		if !empty {
+			if err := n.flushChild(toIndex); err != nil {
+				return false, err
+			}
+		} else {
+			toIndex++
 		}
 	}
-	return false
+
+	n.pointers = append(n.pointers[:fromIndex], n.pointers[toIndex:]...)
+	return len(n.pointers) == 0, nil
 }
 
-func (n *node) cleanFrom(from *Time) bool {
+// cleanFrom removes the points after from, returns true if the node is empty.
+func (n *node) cleanFrom(from *Time) (bool, error) {
 	if n.isLeaf {
 		index := sort.Search(len(n.points), func(i int) bool {
 			return n.points[i].Timestamp >= from.TS
 		})
-		if index == 0 {
-			return true
-		}
 		n.points = n.points[:index]
-		return false
-	} else {
-		f := from.Timestamp(n.level << 1)
-		fromIndex := sort.Search(len(n.pointers), func(i int) bool {
-			return n.pointers[i].key >= f
-		})
-
-		if fromIndex >= len(n.pointers) {
-			return false
-		}
-		if n.pointers[fromIndex].key == f {
-			// if from time is the begin of node, drop it directly.
-			if f != from.TS {
-				if n.pointers[fromIndex].pointer == nil {
-					var err error
-					n.pointers[fromIndex].pointer, err = n.db.node(n.pointers[fromIndex].pos)
-					if err != nil {
-						return true
-					}
-				}
-				empty := n.pointers[fromIndex].pointer.cleanFrom(from)
-				if !empty {
-					n.pointers[fromIndex].pointer.reduce()
-					n.pointers[fromIndex].pos = n.pointers[fromIndex].pointer.flush()
+		return len(n.points) == 0, nil
+	}
 
-					// persist fromIndex
-					fromIndex++
-				}
-			}
+	if err := n.flushDirty(); err != nil {
+		return false, err
+	}
+	f := from.Timestamp(n.level << 1)
+	fromIndex := sort.Search(len(n.pointers), func(i int) bool {
+		return n.pointers[i].key >= f
+	})
+	if fromIndex < len(n.pointers) && n.pointers[fromIndex].key == f && f != from.TS {
+		// if from time is the begin of node, drop it directly.
+		child, err := n.child(fromIndex)
+		if err != nil {
+			return false, err
 		}
-		if fromIndex == 0 {
-			return true
+		n.pointers[fromIndex].pos = 0
+		empty, err := child.cleanFrom(from)
+		if err != nil {
+			return false, err
+		}
+		if !empty {
+			if err := n.flushChild(fromIndex); err != nil {
+				return false, err
+			}
+
+			// persist fromIndex
+			fromIndex++
 		}
-		n.pointers = n.pointers[:fromIndex]
-		return false
 	}
+	n.pointers = n.pointers[:fromIndex]
+	return len(n.pointers) == 0, nil
 }
 
-func (n *node) cleanTo(to *Time) bool {
+// cleanTo removes the points before to, returns true if the node is empty.
+func (n *node) cleanTo(to *Time) (bool, error) {
 	if n.isLeaf {
 		index := sort.Search(len(n.points), func(i int) bool {
 			return n.points[i].Timestamp >= to.TS
 		})
-		if index == len(n.points) {
-			return true
-		}
 		n.points = n.points[index:]
-		return false
-	} else {
-		t := to.Timestamp(n.level << 1)
-		toIndex := sort.Search(len(n.pointers), func(i int) bool {
-			return n.pointers[i].key >= t
-		})
+		return len(n.points) == 0, nil
+	}
 
-		if toIndex == len(n.pointers) {
-			return true
-		}
-		if n.pointers[toIndex].key == t {
-			if t != to.TS {
-				if n.pointers[toIndex].pointer == nil {
-					var err error
-					n.pointers[toIndex].pointer, err = n.db.node(n.pointers[toIndex].pos)
-					if err != nil {
-						return true
-					}
-				}
-				empty := n.pointers[toIndex].pointer.cleanTo(to)
-				if !empty {
-					n.pointers[toIndex].pointer.reduce()
-					n.pointers[toIndex].pos = n.pointers[toIndex].pointer.flush()
-				} else {
-					toIndex++
-				}
+	if err := n.flushDirty(); err != nil {
+		return false, err
+	}
+	t := to.Timestamp(n.level << 1)
+	toIndex := sort.Search(len(n.pointers), func(i int) bool {
+		return n.pointers[i].key >= t
+	})
+	if toIndex < len(n.pointers) && n.pointers[toIndex].key == t && t != to.TS {
+		child, err := n.child(toIndex)
+		if err != nil {
+			return false, err
+		}
+		n.pointers[toIndex].pos = 0
+		empty, err := child.cleanTo(to)
+		if err != nil {
+			return false, err
+		}
+		if !empty {
+			if err := n.flushChild(toIndex); err != nil {
+				return false, err
 			}
+		} else {
+			toIndex++
 		}
-		n.dirty = -1
-		if toIndex == len(n.pointers) {
-			return true
+	}
+	n.pointers = n.pointers[toIndex:]
+	return len(n.pointers) == 0, nil
+}
+
+// fields adds the fields of the points under n to names.
+func (n *node) fields(names map[string]bool) {
+	if n.isLeaf {
+		for _, point := range n.points {
+			for k := range point.Value {
+				names[k] = true
+			}
+		}
+		return
+	}
+	for i, np := range n.pointers {
+		// The aggregates of the dirty branch are reduced when it is flushed.
+		if i == n.dirty {
+			np.pointer.fields(names)
+			continue
+		}
+		for k := range np.value {
+			names[k] = true
 		}
-		n.pointers = n.pointers[toIndex:]
-		return false
 	}
 }
 
+// reduce returns the aggregates of the points under n, the aggregates of the
+// dirty branch are updated first.
 func (n *node) reduce() map[string]Value {
 	value := make(map[string]Value)
 	if n.isLeaf {
-		for index, point := range n.points {
+		for _, point := range n.points {
 			for k, v := range point.Value {
-				if vk, ok := value[k]; !ok {
-					value[k] = Value{
-						sum:   v,
-						max:   v,
-						min:   v,
-						first: v,
-						last:  v,
-						count: 1,
-					}
-				} else {
-					vk.sum += v
-					if vk.max < v {
-						vk.max = v
-					} else if value[k].min > v {
-						vk.min = v
-					}
-					if index == len(n.points)-1 {
-						vk.last = v
-					}
-					vk.count++
-
+				if vk, ok := value[k]; ok {
+					vk.merge(pointValue(point.Timestamp, v))
 					value[k] = vk
-				}
-			}
-		}
-	} else {
-		if n.dirty != -1 {
-			n.pointers[n.dirty].value = n.pointers[n.dirty].pointer.reduce()
-		}
-		for index, pointer := range n.pointers {
-			for k, v := range pointer.value {
-				if vk, ok := value[k]; !ok {
-					value[k] = v
 				} else {
-					vk.sum += v.sum
-					if vk.max < v.max {
-						vk.max = v.max
-					}
-					if value[k].min < v.min {
-						vk.min = v.min
-					}
-					if index == len(n.pointers)-1 {
-						vk.last = v.last
-					}
-					vk.count += v.count
-					value[k] = vk
+					value[k] = pointValue(point.Timestamp, v)
 				}
 			}
 		}
+		return value
+	}
+
+	if n.dirty != -1 {
+		n.pointers[n.dirty].value = n.pointers[n.dirty].pointer.reduce()
+	}
+	for _, pointer := range n.pointers {
+		mergeValues(value, pointer.value)
 	}
 	return value
 }
@@ -0,0 +1,737 @@
+package storage
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Levels of groups which are not levels of the tree. They are ordered
+// between the levels of the tree, and merged from months and days.
+const (
+	LevelQuarter = 0x0003
+	LevelWeek    = 0x0006
+)
+
+// Group describes the buckets a query aggregates the points into.
+type Group struct {
+	// Level is the calendar unit of the buckets, one of the Level constants.
+	Level uint16
+
+	// Count is the number of units of Level in a bucket, 1 if zero. Years,
+	// quarters, months and days are counted from year 0 and 1970-01-01 in
+	// the time zone of the buckets, so 3 months are a quarter. Weeks are
+	// counted from the week of 1970-01-01. Smaller units are counted from
+	// the start of every day.
+	Count int
+
+	// Offset moves the bucket boundaries later, or earlier if negative.
+	Offset time.Duration
+
+	// WeekStart is the first day of weeks, numbered as in ISO 8601 from
+	// Monday (1) to Sunday (7). If zero, weeks start on Monday.
+	WeekStart int
+
+	// Location is the time zone of the bucket boundaries. If nil, the time
+	// zone of the database is used.
+	Location *time.Location
+}
+
+// validate returns ErrInvalidGroup unless the level of g is one of the
+// levels of groups.
+func (g *Group) validate() error {
+	switch g.Level {
+	case LevelYear, LevelQuarter, LevelMonth, LevelWeek, LevelDay, LevelHour,
+		LevelMinute, LevelSecond, LevelMSecond, LevelUSecond, LevelNSecond:
+		return nil
+	}
+	return ErrInvalidGroup
+}
+
+// level returns the level of the tree the buckets are merged from.
+func (g *Group) level() uint16 {
+	switch g.Level {
+	case LevelQuarter:
+		return LevelMonth
+	case LevelWeek:
+		return LevelDay
+	}
+	return g.Level
+}
+
+// start returns the start of the bucket that ts is in.
+func (g *Group) start(ts int64, loc *time.Location) int64 {
+	offset := int64(g.Offset)
+	t := timeIn(ts-offset, loc)
+	level, n := g.Level, int64(g.Count)
+	if n < 1 {
+		n = 1
+	}
+	if level == LevelQuarter {
+		level, n = LevelMonth, 3*n
+	}
+	if n == 1 && level != LevelWeek {
+		return t.Timestamp(level) + offset
+	}
+
+	year, month, day := t.Time.Date()
+	switch level {
+	case LevelYear:
+		year = int(floorDiv(int64(year), n) * n)
+		return time.Date(year, 1, 1, 0, 0, 0, 0, loc).UnixNano() + offset
+	case LevelMonth:
+		months := floorDiv(int64(year)*12+int64(month)-1, n) * n
+		return time.Date(0, time.Month(months+1), 1, 0, 0, 0, 0, loc).UnixNano() + offset
+	case LevelWeek:
+		// 1970-01-01 was a Thursday, the week it is in starts shift days
+		// earlier.
+		weekStart := g.WeekStart
+		if weekStart == 0 {
+			weekStart = 1
+		}
+		shift := (int64(time.Thursday) - int64(weekStart%7) + 7) % 7
+		days := time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix()/86400 + shift
+		days = floorDiv(days, 7*n)*7*n - shift
+		return time.Date(1970, 1, int(days+1), 0, 0, 0, 0, loc).UnixNano() + offset
+	case LevelDay:
+		days := time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / 86400
+		days = floorDiv(days, n) * n
+		return time.Date(1970, 1, int(days+1), 0, 0, 0, 0, loc).UnixNano() + offset
+	}
+	size := n * int64(levelDuration(level))
+	day0 := t.Timestamp(LevelDay)
+	return day0 + floorDiv(t.TS-day0, size)*size + offset
+}
+
+// next returns the start of the bucket following the one starting at start.
+func (g *Group) next(start int64, loc *time.Location) int64 {
+	offset := int64(g.Offset)
+	t := time.Unix(0, start-offset).In(loc)
+	n := g.Count
+	if n < 1 {
+		n = 1
+	}
+
+	year, month, day := t.Date()
+	var end time.Time
+	switch g.Level {
+	case LevelYear:
+		end = time.Date(year+n, 1, 1, 0, 0, 0, 0, loc)
+	case LevelQuarter:
+		end = time.Date(year, month+time.Month(3*n), 1, 0, 0, 0, 0, loc)
+	case LevelMonth:
+		end = time.Date(year, month+time.Month(n), 1, 0, 0, 0, 0, loc)
+	case LevelWeek:
+		end = time.Date(year, month, day+7*n, 0, 0, 0, 0, loc)
+	case LevelDay:
+		end = time.Date(year, month, day+n, 0, 0, 0, 0, loc)
+	default:
+		// The buckets start again at midnight.
+		end = t.Add(time.Duration(n) * levelDuration(g.Level))
+		if midnight := time.Date(year, month, day+1, 0, 0, 0, 0, loc); midnight.Before(end) {
+			end = midnight
+		}
+	}
+	return end.UnixNano() + offset
+}
+
+// floorDiv returns a / b rounded down.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// levelDuration returns the length of the periods of a level below a day.
+func levelDuration(level uint16) time.Duration {
+	switch level {
+	case LevelHour:
+		return time.Hour
+	case LevelMinute:
+		return time.Minute
+	case LevelSecond:
+		return time.Second
+	case LevelMSecond:
+		return time.Millisecond
+	case LevelUSecond:
+		return time.Microsecond
+	}
+	return time.Nanosecond
+}
+
+// durationLevel returns the coarsest level below a day whose periods d is a
+// multiple of.
+func durationLevel(d time.Duration) uint16 {
+	for _, level := range []uint16{LevelHour, LevelMinute, LevelSecond, LevelMSecond, LevelUSecond} {
+		if d%levelDuration(level) == 0 {
+			return level
+		}
+	}
+	return LevelNSecond
+}
+
+// maxZoneTransitions bounds the transitions looked at by zoneAlignment, the
+// offsets of later years follow the same rules.
+const maxZoneTransitions = 1024
+
+// QueryOptions are the options of Query.
+type QueryOptions struct {
+	// Fill is how the buckets without points are returned, they are left
+	// out by default.
+	Fill FillPolicy
+
+	// FillValue is the value of the fields of empty buckets with
+	// FillConstant.
+	FillValue float64
+
+	// Filter selects the points which are aggregated, all of them if it is
+	// nil. The buckets are then merged from the points, not from the
+	// aggregates of the tree.
+	Filter *Filter
+
+	// Windows are computed in their order over the buckets, after they are
+	// filled.
+	Windows []Window
+
+	// Desc returns the buckets from the last one.
+	Desc bool
+
+	// Offset is the number of buckets skipped, in the order they are
+	// returned.
+	Offset int
+
+	// Limit is the number of buckets returned at most, all of them if it
+	// is 0. Only the buckets up to it are read, apart from the ones needed
+	// by a CumulativeSum window.
+	Limit int
+}
+
+// Query aggregates the points in the buckets of group, from the bucket which
+// from is in up to the last bucket starting before to. Every bucket is one
+// point, with the fields reduced by the reducers named in reducer. If options
+// is nil, the default options are used.
+//
+// The buckets are merged from the aggregates of the tree at the level of
+// group. In another time zone than the one of the database, or with an
+// offset, they are merged from the coarsest level whose boundaries agree
+// with the ones of the buckets.
+func (db *DB) Query(from int64, to int64, group Group, reducer map[string]string, options *QueryOptions) ([]*Point, error) {
+	db.rwlock.RLock()
+	defer db.rwlock.RUnlock()
+
+	if !db.opened {
+		return nil, ErrDatabaseNotOpen
+	}
+	if err := group.validate(); err != nil {
+		return nil, err
+	}
+	if options == nil {
+		options = &QueryOptions{}
+	}
+	if options.Filter != nil {
+		if err := options.Filter.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if options.Offset < 0 || options.Limit < 0 {
+		return nil, ErrInvalidLimit
+	}
+	// A window of the field of an earlier window looks back over the
+	// buckets the earlier one needs too, which have the field of the
+	// earlier one.
+	needs := make(map[string]int, len(options.Windows))
+	sources := make(map[string]string, len(options.Windows))
+	limit := options.Offset + options.Limit
+	for i := range options.Windows {
+		w := &options.Windows[i]
+		if err := w.validate(); err != nil {
+			return nil, err
+		}
+		if w.Func == CumulativeSum {
+			limit = 0
+		}
+		n := w.lookBack() + needs[w.Field]
+		if n > MaxBuckets {
+			n = MaxBuckets
+		}
+		needs[w.Name] = n
+		sources[w.Name] = w.Field
+		if source, ok := sources[w.Field]; ok {
+			sources[w.Name] = source
+		}
+	}
+	if options.Limit == 0 {
+		limit = 0
+	}
+	if group.Location == nil {
+		group.Location = db.loc
+	}
+
+	// Of the buckets from the end, the ones up to the limit are queried.
+	var err error
+	if limit > 0 && options.Desc {
+		if from, err = db.lastBuckets(from, to, limit, group, options); err != nil {
+			return nil, err
+		}
+	} else if limit > 0 && options.Fill != FillNone {
+		key := group.start(from, group.Location)
+		for i := 0; i < limit && key < to; i++ {
+			key = group.next(key, group.Location)
+		}
+		if key < to {
+			to = key
+		}
+	}
+
+	start := group.start(from, group.Location)
+	from = start
+	for _, w := range options.Windows {
+		if needs[w.Name] == 0 {
+			continue
+		}
+		before, err := db.lookBack(start, needs[w.Name], sources[w.Name], group, reducer, options)
+		if err != nil {
+			return nil, err
+		}
+		if before < from {
+			from = before
+		}
+	}
+
+	var result []*Point
+	buckets := 0
+	err = db.aggregate(from, to, group, options.Filter, func(key int64, value map[string]Value) bool {
+		result = append(result, reducePoint(key, value, reducer))
+		if key >= start {
+			buckets++
+		}
+		return limit == 0 || buckets < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	if options.Fill != FillNone {
+		if result, err = db.fill(result, from, to, group, reducer, options); err != nil {
+			return nil, err
+		}
+	}
+	if len(options.Windows) > 0 {
+		for i := range options.Windows {
+			options.Windows[i].apply(result, start)
+		}
+		for len(result) > 0 && result[0].Timestamp < start {
+			result = result[1:]
+		}
+	}
+
+	if options.Desc {
+		for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+			result[i], result[j] = result[j], result[i]
+		}
+	}
+	if options.Offset >= len(result) {
+		return []*Point{}, nil
+	}
+	result = result[options.Offset:]
+	if options.Limit > 0 && options.Limit < len(result) {
+		result = result[:options.Limit]
+	}
+	return result, nil
+}
+
+// lastBuckets returns the start of the n-th last bucket of group between
+// from and to, counting the empty buckets only if they are filled. It is the
+// bucket which from is in if there are not that many buckets.
+func (db *DB) lastBuckets(from int64, to int64, n int, group Group, options *QueryOptions) (int64, error) {
+	loc := group.Location
+	first := group.start(from, loc)
+	last := group.start(to-1, loc)
+	if options.Fill != FillNone {
+		for i := 1; i < n && last > first; i++ {
+			last = group.start(last-1, loc)
+		}
+		if last < first {
+			return first, nil
+		}
+		return last, nil
+	}
+
+	c := db.groupCursor(from, to, group, options.Filter)
+	var key int64
+	count := 0
+	ok, err := c.seekBefore(group.next(last, loc))
+	for ; ok && err == nil; ok, err = c.prev() {
+		k, v := c.element()
+		bucket := group.start(k, loc)
+		if bucket < first {
+			break
+		}
+		if options.Filter != nil && !options.Filter.match(v) {
+			continue
+		}
+		if count == 0 || bucket != key {
+			key = bucket
+			count++
+			if count == n {
+				return key, nil
+			}
+		}
+	}
+	return first, err
+}
+
+// lookBack returns the start of the n-th bucket with the field name before
+// the bucket starting at start, counting the empty buckets only if they are
+// filled with fields. It is an earlier one if there are not that many
+// buckets.
+func (db *DB) lookBack(start int64, n int, name string, group Group, reducer map[string]string, options *QueryOptions) (int64, error) {
+	loc := group.Location
+	filter := options.Filter
+	if field := queriedField(name, reducer); field != "" {
+		filter = &Filter{Exists: field}
+		if options.Filter != nil {
+			filter = &Filter{And: []*Filter{options.Filter, filter}}
+		}
+	}
+	filled := options.Fill == FillPrevious || options.Fill == FillLinear || options.Fill == FillConstant
+	for i := 0; i < n; i++ {
+		ts, ok, err := db.pointNear(start, false, filter)
+		if err != nil {
+			return start, err
+		}
+		if !filled {
+			if !ok {
+				return start, nil
+			}
+			start = group.start(ts, loc)
+			continue
+		}
+
+		// The empty buckets are filled with the field, the ones with
+		// points have it only if one of them has it.
+		for {
+			prev := group.start(start-1, loc)
+			if ok && group.start(ts, loc) == prev {
+				start = prev
+				break
+			}
+			other, has, err := db.pointNear(start, false, options.Filter)
+			if err != nil {
+				return start, err
+			}
+			start = prev
+			if !has || group.start(other, loc) < prev {
+				break
+			}
+		}
+	}
+	return start, nil
+}
+
+// aggregate calls fn with the start and the aggregates of every bucket of
+// group with points, from the bucket which from is in up to the last bucket
+// starting before to, or until fn returns false. With a filter, only the
+// points it selects are aggregated. The caller must hold the lock of the
+// database.
+func (db *DB) aggregate(from int64, to int64, group Group, filter *Filter, fn func(int64, map[string]Value) bool) error {
+	loc := group.Location
+	if loc == nil {
+		loc = db.loc
+	}
+	c := db.groupCursor(from, to, group, filter)
+
+	var key int64
+	var value map[string]Value
+	ok, err := c.seek(group.start(from, loc))
+	for ; ok && err == nil; ok, err = c.next() {
+		k, v := c.element()
+		bucket := group.start(k, loc)
+		if bucket >= to {
+			break
+		}
+		if filter != nil && !filter.match(v) {
+			continue
+		}
+		if value != nil && bucket != key {
+			if !fn(key, value) {
+				return nil
+			}
+			value = nil
+		}
+		if value == nil {
+			key = bucket
+			value = make(map[string]Value, len(v))
+		}
+		mergeValues(value, v)
+	}
+	if err != nil {
+		return err
+	}
+	if value != nil {
+		fn(key, value)
+	}
+	return nil
+}
+
+// groupCursor returns a cursor at the coarsest level whose elements are in
+// a single bucket of group between from and to, and at the level of the
+// points with a filter.
+func (db *DB) groupCursor(from int64, to int64, group Group, filter *Filter) *Cursor {
+	loc := group.Location
+	if loc == nil {
+		loc = db.loc
+	}
+	c := db.Cursor()
+	c.level = group.level()
+	if filter != nil {
+		c.level = LevelNSecond
+	}
+	if loc.String() != db.loc.String() {
+		if level := zoneAlignment(db.loc, loc, from, to); level > c.level {
+			c.level = level
+		}
+	}
+	if group.Offset != 0 {
+		if level := durationLevel(group.Offset); level > c.level {
+			c.level = level
+		}
+	}
+	return c
+}
+
+// zoneAlignment returns the coarsest level whose periods start at the same
+// instants in both time zones between from and to.
+func zoneAlignment(a, b *time.Location, from int64, to int64) uint16 {
+	align := int(time.Hour / time.Second)
+	for _, loc := range []*time.Location{a, b} {
+		t := time.Unix(0, from).In(loc)
+		for i := 0; i < maxZoneTransitions; i++ {
+			_, offset := t.Zone()
+			for offset%align != 0 {
+				align /= 60
+			}
+			_, end := t.ZoneBounds()
+			if end.IsZero() || end.UnixNano() >= to {
+				break
+			}
+			t = end
+		}
+	}
+
+	switch align {
+	case 3600:
+		return LevelHour
+	case 60:
+		return LevelMinute
+	}
+	return LevelSecond
+}
+
+// pointValue returns the aggregate of a single value at ts.
+func pointValue(ts int64, v float64) Value {
+	return Value{
+		sum:       v,
+		max:       v,
+		min:       v,
+		first:     v,
+		last:      v,
+		count:     1,
+		firstTime: ts,
+		lastTime:  ts,
+		maxTime:   ts,
+		minTime:   ts,
+		sketch:    newSketch(v),
+	}
+}
+
+// merge adds the aggregate o of the points following the ones of v. The
+// sketch of v is changed, it must not be shared.
+func (v *Value) merge(o Value) {
+	if v.sketch == nil {
+		v.sketch = o.sketch.clone()
+	} else {
+		v.sketch.merge(o.sketch)
+	}
+	if n := v.count + o.count; n > 0 {
+		// The squared differences to the means of both parts are moved to
+		// the mean of the merged points.
+		delta := o.mean() - v.mean()
+		v.m2 += o.m2 + delta*delta*float64(v.count)*float64(o.count)/float64(n)
+	}
+	v.sum += o.sum
+	if o.max > v.max {
+		v.max = o.max
+		v.maxTime = o.maxTime
+	}
+	if o.min < v.min {
+		v.min = o.min
+		v.minTime = o.minTime
+	}
+	v.last = o.last
+	v.lastTime = o.lastTime
+	v.count += o.count
+}
+
+// mergeValues merges the aggregates of the following points from into to.
+// The aggregates of from are left unchanged.
+func mergeValues(to map[string]Value, from map[string]Value) {
+	for k, v := range from {
+		if vk, ok := to[k]; ok {
+			vk.merge(v)
+			to[k] = vk
+		} else {
+			v.sketch = v.sketch.clone()
+			to[k] = v
+		}
+	}
+}
+
+// mean returns the average of the points, 0 if there are none.
+func (v *Value) mean() float64 {
+	if v.count == 0 {
+		return 0
+	}
+	return v.sum / float64(v.count)
+}
+
+// reduce returns the aggregate named by reducer, false if there is none.
+func (v *Value) reduce(reducer string) (float64, bool) {
+	switch reducer {
+	case "sum":
+		return v.sum, true
+	case "max":
+		return v.max, true
+	case "min":
+		return v.min, true
+	case "first":
+		return v.first, true
+	case "last":
+		return v.last, true
+	case "count":
+		return float64(v.count), true
+	case "first_time":
+		return float64(v.firstTime), true
+	case "last_time":
+		return float64(v.lastTime), true
+	case "max_time":
+		return float64(v.maxTime), true
+	case "min_time":
+		return float64(v.minTime), true
+	case "avg", "ma":
+		return v.mean(), true
+	case "variance":
+		if v.count < 2 {
+			return 0, true
+		}
+		return v.m2 / float64(v.count-1), true
+	case "stddev":
+		if v.count < 2 {
+			return 0, true
+		}
+		return math.Sqrt(v.m2 / float64(v.count-1)), true
+	case "stddev_pop":
+		if v.count == 0 {
+			return 0, true
+		}
+		return math.Sqrt(v.m2 / float64(v.count)), true
+	case "median":
+		return v.percentile(50), true
+	}
+	if p, ok := parsePercentile(reducer); ok {
+		return v.percentile(p), true
+	}
+	return 0, false
+}
+
+// KnownReducer returns whether reducer names a reducer of Query.
+func KnownReducer(reducer string) bool {
+	_, known := (&Value{}).reduce(reducer)
+	return known
+}
+
+// parsePercentile parses the percentile of a reducer like "p99" or "p99.9".
+func parsePercentile(reducer string) (float64, bool) {
+	if !strings.HasPrefix(reducer, "p") {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(reducer[1:], 64)
+	if err != nil || !(p >= 0 && p <= 100) {
+		return 0, false
+	}
+	return p, true
+}
+
+// percentile returns the value which p percent of the values are less than
+// or equal to, within SketchAccuracy. It is exact for 0 and 100.
+func (v *Value) percentile(p float64) float64 {
+	if v.sketch == nil || v.sketch.count() == 0 {
+		return 0
+	}
+	f := v.sketch.quantile(p / 100)
+	if f < v.min || p == 0 {
+		f = v.min
+	}
+	if f > v.max || p == 100 {
+		f = v.max
+	}
+	return f
+}
+
+// Wildcard names every field of the points in the reducers of a query, the
+// fields named too are reduced by their own reducers.
+const Wildcard = "*"
+
+// reducePoint returns the point of a bucket. A field is reduced by the
+// reducers of its name or of Wildcard, separated by commas if there are
+// several; each of them is a field of the point named like "price.max", a
+// single one keeps the name of the field. The fields which are not in the
+// bucket are left out.
+func reducePoint(key int64, value map[string]Value, reducer map[string]string) *Point {
+	p := &Point{
+		Timestamp: key,
+		Value:     make(map[string]float64, len(reducer)),
+	}
+	for field, v := range value {
+		r, ok := reducer[field]
+		if !ok {
+			if r, ok = reducer[Wildcard]; !ok {
+				continue
+			}
+		}
+		for name, reducer := range reducedFields(field, r) {
+			if f, known := v.reduce(reducer); known {
+				p.Value[name] = f
+			}
+		}
+	}
+	return p
+}
+
+// queriedField returns the field of the points the field name of a bucket is
+// reduced from by reducer, "" if it is none of them.
+func queriedField(name string, reducer map[string]string) string {
+	if field, ok := filledFields(reducer, nil)[name]; ok {
+		return field
+	}
+	if r, ok := reducer[Wildcard]; ok {
+		return wildcardField(name, strings.Split(r, ","))
+	}
+	return ""
+}
+
+// reducedFields returns the fields of a point a field is reduced to by
+// reducers, with their reducer.
+func reducedFields(field string, reducers string) map[string]string {
+	names := strings.Split(reducers, ",")
+	if len(names) == 1 {
+		return map[string]string{field: reducers}
+	}
+	fields := make(map[string]string, len(names))
+	for _, r := range names {
+		fields[field+"."+r] = r
+	}
+	return fields
+}
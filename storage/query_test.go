@@ -0,0 +1,851 @@
+package storage
+
+import (
+	"math"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+var allReducers = map[string]string{
+	"sum":   "sum",
+	"max":   "max",
+	"min":   "min",
+	"first": "first",
+	"last":  "last",
+	"count": "count",
+
+	"first_time": "first_time",
+	"last_time":  "last_time",
+	"max_time":   "max_time",
+	"min_time":   "min_time",
+}
+
+// bruteQuery computes the result of Query from the points directly.
+func bruteQuery(points map[int64]float64, from, to int64, group Group) []*Point {
+	var keys []int64
+	for k := range points {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	start := group.start(from, group.Location)
+	var result []*Point
+	var cur *Point
+	for _, k := range keys {
+		bucket := group.start(k, group.Location)
+		if bucket < start || bucket >= to {
+			continue
+		}
+		v, ts := points[k], float64(k)
+		if cur == nil || cur.Timestamp != bucket {
+			cur = &Point{Timestamp: bucket, Value: map[string]float64{
+				"sum": v, "max": v, "min": v, "first": v, "last": v, "count": 1,
+				"first_time": ts, "last_time": ts, "max_time": ts, "min_time": ts,
+			}}
+			result = append(result, cur)
+			continue
+		}
+		cur.Value["sum"] += v
+		if v > cur.Value["max"] {
+			cur.Value["max"] = v
+			cur.Value["max_time"] = ts
+		}
+		if v < cur.Value["min"] {
+			cur.Value["min"] = v
+			cur.Value["min_time"] = ts
+		}
+		cur.Value["last"] = v
+		cur.Value["last_time"] = ts
+		cur.Value["count"]++
+	}
+	return result
+}
+
+// queryFields runs Query with every reducer on the field "price" and the
+// points selected by filter, naming the results after their reducer like
+// bruteQuery does.
+func queryFields(t *testing.T, db *DB, from, to int64, group Group, filter *Filter) []*Point {
+	var result []*Point
+	for name, reducer := range allReducers {
+		points, err := db.Query(from, to, group, map[string]string{"price": reducer}, &QueryOptions{Filter: filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result == nil {
+			for _, p := range points {
+				result = append(result, &Point{Timestamp: p.Timestamp, Value: map[string]float64{}})
+			}
+		}
+		if len(points) != len(result) {
+			t.Fatalf("%s: expected %d buckets, got %d", name, len(result), len(points))
+		}
+		for i, p := range points {
+			result[i].Value[name] = p.Value["price"]
+		}
+	}
+	return result
+}
+
+func putAll(t *testing.T, db *DB, points map[int64]float64) {
+	for k, v := range points {
+		if err := db.Put(k, map[string]float64{"price": v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Points of every alignment, from whole days down to nanoseconds.
+	r := rand.New(rand.NewSource(1))
+	base := time.Date(2015, 11, 20, 0, 0, 0, 0, time.UTC).UnixNano()
+	points := make(map[int64]float64)
+	units := []int64{int64(24 * time.Hour), int64(time.Hour), int64(time.Minute), int64(time.Second),
+		int64(time.Millisecond), int64(time.Microsecond), 1}
+	for i := 0; i < 2000; i++ {
+		unit := units[i%len(units)]
+		k := base + r.Int63n(int64(400*24*time.Hour))/unit*unit
+		points[k] = float64(r.Intn(1000))
+	}
+	// A burst of ticks within a few seconds.
+	burst := base + int64(100*24*time.Hour)
+	for i := 0; i < 1000; i++ {
+		points[burst+r.Int63n(int64(3*time.Second))] = float64(r.Intn(1000))
+	}
+	putAll(t, db, points)
+
+	from := base + int64(30*24*time.Hour) + int64(5*time.Hour)
+	to := base + int64(300*24*time.Hour)
+	check := func(name string) {
+		for _, group := range []Group{
+			{Level: LevelYear},
+			{Level: LevelMonth},
+			{Level: LevelDay},
+			{Level: LevelHour},
+			{Level: LevelMinute},
+			{Level: LevelSecond},
+			{Level: LevelSecond, Count: 5},
+			{Level: LevelMSecond},
+			{Level: LevelMSecond, Count: 100},
+			{Level: LevelUSecond},
+			{Level: LevelNSecond},
+		} {
+			group.Location = time.UTC
+			want := bruteQuery(points, from, to, group)
+			got := queryFields(t, db, from, to, group, nil)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s, %+v: expected %d buckets, got %d", name, group, len(want), len(got))
+			}
+		}
+	}
+	check("in memory")
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	check("flushed")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check("reopened")
+}
+
+func TestGroupStart(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	date := func(s string, loc *time.Location) int64 {
+		tm, err := time.ParseInLocation("2006-01-02 15:04:05.999999999", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm.UnixNano()
+	}
+
+	tests := []struct {
+		group Group
+		ts    string
+		start string
+	}{
+		{Group{Level: LevelMinute, Count: 5}, "2016-08-28 21:24:59", "2016-08-28 21:20:00"},
+		{Group{Level: LevelMinute, Count: 15}, "2016-08-28 00:14:00", "2016-08-28 00:00:00"},
+		{Group{Level: LevelHour, Count: 4}, "2016-08-28 23:59:00", "2016-08-28 20:00:00"},
+		{Group{Level: LevelHour, Count: 5}, "2016-08-28 23:59:00", "2016-08-28 20:00:00"},
+		{Group{Level: LevelHour, Count: 5}, "2016-08-29 01:00:00", "2016-08-29 00:00:00"},
+		{Group{Level: LevelSecond, Count: 10}, "2016-08-28 21:24:09.5", "2016-08-28 21:24:00"},
+		{Group{Level: LevelDay, Count: 7}, "2016-08-28 21:24:00", "2016-08-25 00:00:00"},
+		{Group{Level: LevelDay, Count: 7}, "1969-12-31 21:24:00", "1969-12-25 00:00:00"},
+		{Group{Level: LevelMonth, Count: 3}, "2016-08-28 21:24:00", "2016-07-01 00:00:00"},
+		{Group{Level: LevelMonth, Count: 3}, "2016-12-31 23:59:59", "2016-10-01 00:00:00"},
+		{Group{Level: LevelMonth, Count: 6}, "1969-05-01 00:00:00", "1969-01-01 00:00:00"},
+		{Group{Level: LevelYear, Count: 10}, "2016-08-28 21:24:00", "2010-01-01 00:00:00"},
+		{Group{Level: LevelWeek}, "2016-08-28 21:24:00", "2016-08-22 00:00:00"},
+		{Group{Level: LevelWeek}, "2016-08-29 00:00:00", "2016-08-29 00:00:00"},
+		{Group{Level: LevelWeek, WeekStart: 7}, "2016-08-28 21:24:00", "2016-08-28 00:00:00"},
+		{Group{Level: LevelWeek, WeekStart: 6}, "2016-08-26 21:24:00", "2016-08-20 00:00:00"},
+		{Group{Level: LevelWeek, Count: 2}, "2016-08-28 21:24:00", "2016-08-22 00:00:00"},
+		{Group{Level: LevelWeek, Count: 2}, "2016-08-21 21:24:00", "2016-08-08 00:00:00"},
+		{Group{Level: LevelWeek}, "1969-12-31 00:00:00", "1969-12-29 00:00:00"},
+		{Group{Level: LevelQuarter}, "2016-08-28 21:24:00", "2016-07-01 00:00:00"},
+		{Group{Level: LevelQuarter}, "2016-03-31 23:59:59", "2016-01-01 00:00:00"},
+		{Group{Level: LevelQuarter, Count: 2}, "2016-08-28 21:24:00", "2016-07-01 00:00:00"},
+		{Group{Level: LevelQuarter, Count: 2}, "2016-06-30 21:24:00", "2016-01-01 00:00:00"},
+		{Group{Level: LevelWeek, Location: ny}, "2016-11-06 23:00:00", "2016-10-31 00:00:00"},
+		{Group{Level: LevelWeek, Location: ny}, "2016-11-07 00:30:00", "2016-11-07 00:00:00"},
+		{Group{Level: LevelMinute, Count: 5, Offset: 2 * time.Minute}, "2016-08-28 21:21:00", "2016-08-28 21:17:00"},
+		{Group{Level: LevelDay, Offset: 17 * time.Hour}, "2016-08-28 16:00:00", "2016-08-27 17:00:00"},
+		{Group{Level: LevelDay, Offset: -7 * time.Hour}, "2016-08-28 18:00:00", "2016-08-28 17:00:00"},
+		{Group{Level: LevelHour, Count: 4, Location: ny}, "2016-08-28 23:59:00", "2016-08-28 20:00:00"},
+		{Group{Level: LevelMonth, Count: 3, Location: ny}, "2016-08-28 21:24:00", "2016-07-01 00:00:00"},
+	}
+	for _, test := range tests {
+		loc := test.group.Location
+		if loc == nil {
+			loc = time.UTC
+		}
+		if start := test.group.start(date(test.ts, loc), loc); start != date(test.start, loc) {
+			t.Errorf("%+v of %s: expected %s, got %s", test.group, test.ts, test.start, time.Unix(0, start).In(loc))
+		}
+	}
+}
+
+func TestGroupNext(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	r := rand.New(rand.NewSource(5))
+	base := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	for _, group := range []Group{
+		{Level: LevelYear},
+		{Level: LevelYear, Count: 3},
+		{Level: LevelQuarter},
+		{Level: LevelMonth, Count: 5},
+		{Level: LevelWeek, WeekStart: 7},
+		{Level: LevelDay},
+		{Level: LevelDay, Count: 3, Offset: -7 * time.Hour},
+		{Level: LevelHour},
+		{Level: LevelHour, Count: 5},
+		{Level: LevelMinute, Count: 7},
+		{Level: LevelSecond, Count: 10},
+		{Level: LevelMSecond, Count: 100},
+		{Level: LevelDay, Location: ny},
+		{Level: LevelHour, Count: 4, Location: ny},
+	} {
+		loc := group.Location
+		if loc == nil {
+			loc = time.UTC
+		}
+		for i := 0; i < 1000; i++ {
+			start := group.start(base+r.Int63n(int64(3*365*24*time.Hour)), loc)
+			next := group.next(start, loc)
+			if next <= start || group.start(next, loc) != next || group.start(next-1, loc) != start {
+				t.Fatalf("%+v: unexpected bucket after %v: %v", group, time.Unix(0, start).In(loc), time.Unix(0, next).In(loc))
+			}
+		}
+	}
+}
+
+func TestQueryCount(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "count"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	r := rand.New(rand.NewSource(2))
+	base := time.Date(2015, 12, 20, 0, 0, 0, 0, time.UTC).UnixNano()
+	points := make(map[int64]float64)
+	for i := 0; i < 3000; i++ {
+		k := base + r.Int63n(int64(200*24*time.Hour))/int64(time.Second)*int64(time.Second)
+		points[k] = float64(r.Intn(1000))
+	}
+	putAll(t, db, points)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	from := base + int64(10*24*time.Hour) + int64(7*time.Minute)
+	to := base + int64(150*24*time.Hour)
+	for _, group := range []Group{
+		{Level: LevelMinute, Count: 5},
+		{Level: LevelMinute, Count: 15, Offset: 5 * time.Minute},
+		{Level: LevelHour, Count: 4},
+		{Level: LevelHour, Count: 7},
+		{Level: LevelDay, Count: 7},
+		{Level: LevelDay, Offset: -7 * time.Hour},
+		{Level: LevelDay, Count: 2, Offset: 90 * time.Second},
+		{Level: LevelMonth, Count: 3},
+		{Level: LevelYear, Count: 2},
+		{Level: LevelWeek},
+		{Level: LevelWeek, Count: 2, WeekStart: 7},
+		{Level: LevelQuarter},
+	} {
+		group.Location = time.UTC
+		want := bruteQuery(points, from, to, group)
+		if got := queryFields(t, db, from, to, group, nil); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%+v: expected %d buckets, got %d", group, len(want), len(got))
+		}
+	}
+}
+
+func TestTimestampDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	// Daylight saving time ends at 2:00 EDT, 1:00 to 2:00 is repeated.
+	first := NewTimeIn(time.Date(2016, 11, 6, 5, 30, 0, 0, time.UTC).UnixNano(), ny)
+	second := NewTimeIn(time.Date(2016, 11, 6, 6, 30, 0, 0, time.UTC).UnixNano(), ny)
+	if h := first.Timestamp(LevelHour); h != time.Date(2016, 11, 6, 5, 0, 0, 0, time.UTC).UnixNano() {
+		t.Fatalf("unexpected hour of the first 1:30: %v", time.Unix(0, h).UTC())
+	}
+	if h := second.Timestamp(LevelHour); h != time.Date(2016, 11, 6, 6, 0, 0, 0, time.UTC).UnixNano() {
+		t.Fatalf("unexpected hour of the second 1:30: %v", time.Unix(0, h).UTC())
+	}
+	day := time.Date(2016, 11, 6, 4, 0, 0, 0, time.UTC).UnixNano()
+	if first.Timestamp(LevelDay) != day || second.Timestamp(LevelDay) != day {
+		t.Fatal("expected both to be in the day starting at 0:00 EDT")
+	}
+	if l := second.Level(); l != LevelMinute {
+		t.Fatalf("expected minute level, got %x", l)
+	}
+
+	// Daylight saving time starts at 2:00 EST, the day has 23 hours.
+	t3 := NewTimeIn(time.Date(2016, 3, 13, 7, 0, 0, 0, time.UTC).UnixNano(), ny)
+	if h := t3.Time.Hour(); h != 3 {
+		t.Fatalf("expected 3:00 EDT, got %d:00", h)
+	}
+	if l := t3.Level(); l != LevelHour {
+		t.Fatalf("expected hour level, got %x", l)
+	}
+	if d := t3.Timestamp(LevelDay); d != time.Date(2016, 3, 13, 5, 0, 0, 0, time.UTC).UnixNano() {
+		t.Fatalf("unexpected day: %v", time.Unix(0, d).UTC())
+	}
+}
+
+func TestQueryLocation(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	dir := t.TempDir()
+	utc, err := Open(filepath.Join(dir, "utc"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer utc.Close()
+	local, err := Open(filepath.Join(dir, "ny"), &Options{Location: ny})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every 15 minutes around both transitions of 2016.
+	points := make(map[int64]float64)
+	for _, day := range []time.Time{
+		time.Date(2016, 3, 11, 0, 0, 0, 0, time.UTC),
+		time.Date(2016, 11, 4, 0, 0, 0, 0, time.UTC),
+	} {
+		for i := 0; i < 5*24*4; i++ {
+			points[day.Add(time.Duration(i)*15*time.Minute).UnixNano()] = float64(i % 97)
+		}
+	}
+	putAll(t, utc, points)
+	putAll(t, local, points)
+
+	from := time.Date(2016, 1, 1, 0, 0, 0, 0, ny).UnixNano()
+	to := time.Date(2017, 1, 1, 0, 0, 0, 0, ny).UnixNano()
+	for _, level := range []uint16{LevelQuarter, LevelMonth, LevelWeek, LevelDay, LevelHour} {
+		group := Group{Level: level, Location: ny}
+		want := bruteQuery(points, from, to, group)
+		if got := queryFields(t, utc, from, to, group, nil); !reflect.DeepEqual(got, want) {
+			t.Fatalf("utc index, level %x: results differ", level)
+		}
+		if got := queryFields(t, local, from, to, Group{Level: level}, nil); !reflect.DeepEqual(got, want) {
+			t.Fatalf("new york index, level %x: results differ", level)
+		}
+	}
+
+	// The days of the transitions have 23 and 25 hours.
+	counts := make(map[string]float64)
+	for _, p := range queryFields(t, utc, from, to, Group{Level: LevelDay, Location: ny}, nil) {
+		counts[time.Unix(0, p.Timestamp).In(ny).Format("2006-01-02")] = p.Value["count"]
+	}
+	if counts["2016-03-13"] != 23*4 || counts["2016-11-06"] != 25*4 {
+		t.Fatalf("unexpected counts %v %v", counts["2016-03-13"], counts["2016-11-06"])
+	}
+
+	// Half hour offsets are merged from minutes.
+	group := Group{Level: LevelHour, Location: kolkata}
+	if got, want := queryFields(t, utc, from, to, group, nil), bruteQuery(points, from, to, group); !reflect.DeepEqual(got, want) {
+		t.Fatal("kolkata hours differ")
+	}
+
+	// The time zone is kept by the database.
+	if err := local.Close(); err != nil {
+		t.Fatal(err)
+	}
+	local, err = Open(filepath.Join(dir, "ny"), &Options{Location: kolkata})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	if name := local.Location().String(); name != "America/New_York" {
+		t.Fatalf("expected America/New_York, got %s", name)
+	}
+	if name := utc.Location().String(); name != "UTC" {
+		t.Fatalf("expected UTC, got %s", name)
+	}
+}
+
+func TestQueryPercentile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "percentile")
+	db, err := Open(path, &Options{SyncPolicy: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Latencies every 5 minutes for three months.
+	r := rand.New(rand.NewSource(3))
+	base := time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+	months := make(map[int64][]float64)
+	for ts := base; ts.Before(base.AddDate(0, 3, 0)); ts = ts.Add(5 * time.Minute) {
+		v := math.Exp(r.NormFloat64()) * 20
+		if err := db.Put(ts.UnixNano(), map[string]float64{"latency": v}); err != nil {
+			t.Fatal(err)
+		}
+		month := time.Date(ts.Year(), ts.Month(), 1, 0, 0, 0, 0, time.UTC).UnixNano()
+		months[month] = append(months[month], v)
+	}
+
+	check := func(name string) {
+		for _, reducer := range []string{"p0", "p50", "median", "p90", "p99", "p99.9", "p100"} {
+			points, err := db.Query(base.UnixNano(), base.AddDate(1, 0, 0).UnixNano(), Group{Level: LevelMonth}, map[string]string{"latency": reducer}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(points) != 3 {
+				t.Fatalf("%s: expected 3 months, got %d", name, len(points))
+			}
+			for _, p := range points {
+				values := months[p.Timestamp]
+				sort.Float64s(values)
+				q, ok := parsePercentile(reducer)
+				if !ok {
+					q = 50
+				}
+				want := values[int(q/100*float64(len(values)-1))]
+				got := p.Value["latency"]
+				if math.Abs(got-want) > SketchAccuracy*want {
+					t.Fatalf("%s, %s of %v: expected %v, got %v", name, reducer, time.Unix(0, p.Timestamp).UTC(), want, got)
+				}
+				if (q == 0 || q == 100) && got != want {
+					t.Fatalf("%s, %s: expected exactly %v, got %v", name, reducer, want, got)
+				}
+			}
+		}
+	}
+	check("in memory")
+	for _, reducer := range []string{"p-1", "p100.5", "p200", "pNaN", "p"} {
+		if KnownReducer(reducer) {
+			t.Fatalf("expected %s to be unknown", reducer)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check("reopened")
+}
+
+func TestQueryVariance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "variance")
+	db, err := Open(path, &Options{SyncPolicy: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Returns around a large price, so the sum of squares would lose them.
+	r := rand.New(rand.NewSource(4))
+	base := time.Date(2016, 8, 1, 0, 0, 0, 0, time.UTC)
+	var points []Point
+	days := make(map[int64][]float64)
+	for i := 0; i < 100000; i++ {
+		ts := base.Add(time.Duration(i) * 20 * time.Second)
+		v := 1e6 + r.NormFloat64()*float64(1+ts.Day()%3)
+		points = append(points, Point{Timestamp: ts.UnixNano(), Value: map[string]float64{"price": v}})
+		day := time.Date(ts.Year(), ts.Month(), ts.Day(), 0, 0, 0, 0, time.UTC).UnixNano()
+		days[day] = append(days[day], v)
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(group Group, reducer string) []*Point {
+		points, err := db.Query(base.UnixNano(), base.AddDate(1, 0, 0).UnixNano(), group, map[string]string{"price": reducer}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return points
+	}
+	check := func(name string) {
+		for _, reducer := range []string{"variance", "stddev", "stddev_pop"} {
+			for _, p := range query(Group{Level: LevelDay}, reducer) {
+				values := days[p.Timestamp]
+				var sum, m2 float64
+				for _, v := range values {
+					sum += v
+				}
+				mean := sum / float64(len(values))
+				for _, v := range values {
+					m2 += (v - mean) * (v - mean)
+				}
+				want := m2 / float64(len(values)-1)
+				switch reducer {
+				case "stddev":
+					want = math.Sqrt(want)
+				case "stddev_pop":
+					want = math.Sqrt(m2 / float64(len(values)))
+				}
+				if got := p.Value["price"]; math.Abs(got-want) > 1e-6*want {
+					t.Fatalf("%s, %s of %v: expected %v, got %v", name, reducer, time.Unix(0, p.Timestamp).UTC(), want, got)
+				}
+			}
+		}
+
+		// More points than fit in 16 bits.
+		count := query(Group{Level: LevelYear}, "count")
+		if len(count) != 1 || count[0].Value["price"] != 100000 {
+			t.Fatalf("%s: unexpected count %v", name, count)
+		}
+	}
+	check("in memory")
+	for _, reducer := range []string{"p-1", "p100.5", "p200", "pNaN", "p"} {
+		if KnownReducer(reducer) {
+			t.Fatalf("expected %s to be unknown", reducer)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check("reopened")
+}
+
+func TestQueryProjection(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "projection"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC)
+	hours := func(h int) int64 {
+		return base.Add(time.Duration(h) * time.Hour).UnixNano()
+	}
+	for h, value := range map[int]map[string]float64{
+		0: {"price": 1, "volume": 10},
+		1: {"price": 3},
+		3: {"volume": 20},
+	} {
+		if err := db.Put(hours(h), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		reducer map[string]string
+		options *QueryOptions
+		want    []map[string]float64
+	}{
+		{
+			map[string]string{"price": "max", "volume": "sum", "missing": "sum"},
+			nil,
+			[]map[string]float64{{"price": 1, "volume": 10}, {"price": 3}, {"volume": 20}},
+		},
+		{
+			map[string]string{Wildcard: "last"},
+			nil,
+			[]map[string]float64{{"price": 1, "volume": 10}, {"price": 3}, {"volume": 20}},
+		},
+		{
+			map[string]string{Wildcard: "count", "price": "min,max,avg"},
+			nil,
+			[]map[string]float64{
+				{"price.min": 1, "price.max": 1, "price.avg": 1, "volume": 1},
+				{"price.min": 3, "price.max": 3, "price.avg": 3},
+				{"volume": 1},
+			},
+		},
+		{
+			map[string]string{"price": "min,max", "volume": "unknown"},
+			nil,
+			[]map[string]float64{{"price.min": 1, "price.max": 1}, {"price.min": 3, "price.max": 3}, {}},
+		},
+		{
+			map[string]string{Wildcard: "sum"},
+			&QueryOptions{Fill: FillConstant},
+			[]map[string]float64{{"price": 1, "volume": 10}, {"price": 3}, {"price": 0, "volume": 0}, {"volume": 20}},
+		},
+		{
+			map[string]string{Wildcard: "sum"},
+			&QueryOptions{Fill: FillPrevious},
+			[]map[string]float64{{"price": 1, "volume": 10}, {"price": 3}, {"price": 3, "volume": 10}, {"volume": 20}},
+		},
+	}
+	for _, test := range tests {
+		points, err := db.Query(hours(0), hours(4), Group{Level: LevelHour}, test.reducer, test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []map[string]float64
+		for _, p := range points {
+			got = append(got, p.Value)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Fatalf("%v: expected %v, got %v", test.reducer, test.want, got)
+		}
+	}
+}
+
+func TestQueryOrder(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "order"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	r := rand.New(rand.NewSource(1))
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC)
+	var points []Point
+	for i := 0; i < 500; i++ {
+		ts := base.Add(time.Duration(r.Int63n(int64(72 * time.Hour)))).UnixNano()
+		points = append(points, Point{Timestamp: ts, Value: map[string]float64{"price": float64(r.Intn(100))}})
+	}
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	reducer := map[string]string{"price": "sum"}
+	from, to := base.Add(3*time.Hour).UnixNano(), base.Add(70*time.Hour).UnixNano()
+	groups := []Group{
+		{Level: LevelNSecond},
+		{Level: LevelMinute, Count: 30},
+		{Level: LevelHour, Count: 4, Offset: 30 * time.Minute},
+		{Level: LevelDay},
+	}
+	options := []QueryOptions{
+		{},
+		{Fill: FillNull},
+		{Fill: FillLinear},
+		{Filter: &Filter{Field: "price", Op: ">", Value: 50}},
+		{Windows: []Window{{Name: "ma", Field: "price", Func: MovingAverage, N: 3}}},
+		{Windows: []Window{{Name: "sum", Field: "price", Func: CumulativeSum}}},
+	}
+	for _, group := range groups {
+		for _, o := range options {
+			if group.Level == LevelNSecond && o.Fill != FillNone {
+				continue
+			}
+			all, err := db.Query(from, to, group, reducer, &o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, desc := range []bool{false, true} {
+				want := append([]*Point(nil), all...)
+				if desc {
+					for i, j := 0, len(want)-1; i < j; i, j = i+1, j-1 {
+						want[i], want[j] = want[j], want[i]
+					}
+				}
+				for _, limits := range [][2]int{{0, 0}, {0, 1}, {0, 5}, {3, 0}, {3, 7}, {len(want) - 2, 5}, {len(want), 1}} {
+					offset, limit := limits[0], limits[1]
+					opts := o
+					opts.Desc, opts.Offset, opts.Limit = desc, offset, limit
+					got, err := db.Query(from, to, group, reducer, &opts)
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					w := want[offset:]
+					if limit > 0 && limit < len(w) {
+						w = w[:limit]
+					}
+					if len(got) != len(w) {
+						t.Fatalf("%+v %+v: expected %d buckets, got %d", group, opts, len(w), len(got))
+					}
+					for i := range w {
+						if !reflect.DeepEqual(got[i], w[i]) {
+							t.Fatalf("%+v %+v, bucket %d: expected %v, got %v", group, opts, i, w[i], got[i])
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// Only the buckets up to the limit are filled.
+	got, err := db.Query(from, to, Group{Level: LevelNSecond}, reducer, &QueryOptions{Fill: FillNull, Desc: true, Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0].Timestamp != to-1 || got[2].Timestamp != to-3 {
+		t.Fatalf("expected the 3 last nanoseconds, got %v", got)
+	}
+
+	if _, err := db.Query(from, to, Group{Level: LevelHour}, reducer, &QueryOptions{Limit: -1}); err != ErrInvalidLimit {
+		t.Fatalf("expected ErrInvalidLimit, got %v", err)
+	}
+}
+
+func TestQueryOrderFill(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "order"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC)
+	hours := func(h int) int64 {
+		return base.Add(time.Duration(h) * time.Hour).UnixNano()
+	}
+	// The buckets are sparse, and most of them have only some fields.
+	r := rand.New(rand.NewSource(1))
+	var points []Point
+	for i := 0; i < 40; i++ {
+		ts := base.Add(time.Duration(r.Int63n(int64(72 * time.Hour)))).UnixNano()
+		value := map[string]float64{"price": float64(r.Intn(100))}
+		if r.Intn(4) == 0 {
+			value["volume"] = float64(r.Intn(2000))
+		}
+		points = append(points, Point{Timestamp: ts, Value: value})
+	}
+	points = append(points,
+		Point{Timestamp: hours(72), Value: map[string]float64{"price": 1, "volume": 0}},
+		Point{Timestamp: hours(76), Value: map[string]float64{"price": 2}},
+		Point{Timestamp: hours(80), Value: map[string]float64{"price": 3, "volume": 4}},
+	)
+	if err := db.PutBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	// A limited query returns the buckets of the whole one, filled the same.
+	ranges := [][2]int64{{hours(3), hours(70)}, {hours(72), hours(81)}}
+	reducers := []map[string]string{
+		{"price": "last", "volume": "sum"},
+		{Wildcard: "max,count"},
+	}
+	options := []QueryOptions{
+		{Fill: FillNull},
+		{Fill: FillConstant, FillValue: -1},
+		{Fill: FillPrevious},
+		{Fill: FillLinear},
+		{Fill: FillPrevious, Filter: &Filter{Field: "price", Op: ">", Value: 30}},
+		{Fill: FillLinear, Filter: &Filter{Field: "price", Op: "<", Value: 70}},
+		{Fill: FillPrevious, Windows: []Window{{Name: "d", Field: "volume", Func: Difference}}},
+	}
+	for _, rng := range ranges {
+		for _, reducer := range reducers {
+			for _, o := range options {
+				all, err := db.Query(rng[0], rng[1], Group{Level: LevelHour}, reducer, &o)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, desc := range []bool{false, true} {
+					want := append([]*Point(nil), all...)
+					if desc {
+						for i, j := 0, len(want)-1; i < j; i, j = i+1, j-1 {
+							want[i], want[j] = want[j], want[i]
+						}
+					}
+					for _, limits := range [][2]int{{0, 1}, {0, 3}, {2, 3}, {len(want) - 4, 3}} {
+						offset, limit := limits[0], limits[1]
+						opts := o
+						opts.Desc, opts.Offset, opts.Limit = desc, offset, limit
+						got, err := db.Query(rng[0], rng[1], Group{Level: LevelHour}, reducer, &opts)
+						if err != nil {
+							t.Fatal(err)
+						}
+						w := want[offset : offset+limit]
+						if !reflect.DeepEqual(got, w) {
+							t.Fatalf("%v %+v: expected %v, got %v", reducer, opts, pointValues(w), pointValues(got))
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// The volume is interpolated between the buckets with it.
+	got, err := db.Query(hours(72), hours(81), Group{Level: LevelHour}, map[string]string{"volume": "sum"}, &QueryOptions{Fill: FillLinear, Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{0, 0.5, 1}; !reflect.DeepEqual(pointValues(got), [][]float64{{want[0]}, {want[1]}, {want[2]}}) {
+		t.Fatalf("expected %v, got %v", want, pointValues(got))
+	}
+}
+
+// pointValues returns the values of the fields of points, sorted by name.
+func pointValues(points []*Point) [][]float64 {
+	values := make([][]float64, len(points))
+	for i, p := range points {
+		names := make([]string, 0, len(p.Value))
+		for name := range p.Value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			values[i] = append(values[i], p.Value[name])
+		}
+	}
+	return values
+}
+
+func TestQueryInvalidGroup(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "group"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	from := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC).UnixNano()
+	to := from + int64(time.Hour)
+	for _, level := range []uint16{0, LevelRoot, 0x0005, LevelHour | LevelMinute} {
+		if _, err := db.Query(from, to, Group{Level: level}, map[string]string{"price": "sum"}, nil); err != ErrInvalidGroup {
+			t.Fatalf("level %#x: expected ErrInvalidGroup, got %v", level, err)
+		}
+		if _, err := db.Candles(from, to, Group{Level: level}, "price", "", false); err != ErrInvalidGroup {
+			t.Fatalf("candles, level %#x: expected ErrInvalidGroup, got %v", level, err)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+const (
+	// SketchAccuracy is the relative error of the percentiles of a sketch.
+	SketchAccuracy = 0.01
+
+	// sketchMaxBins bounds the bins of the positive and of the negative
+	// values. With 512 bins, values down to about 1/25000 of the largest one
+	// keep the accuracy, smaller ones are merged into the lowest bin.
+	sketchMaxBins = 512
+)
+
+var (
+	sketchGamma    = (1 + SketchAccuracy) / (1 - SketchAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+
+	// sketchMaxKey is the bin of the largest float64, infinities go there.
+	sketchMaxKey = sketchKey(math.MaxFloat64)
+)
+
+// sketch approximates the distribution of values with the bins of a
+// DDSketch: bin i counts the values in (gamma^(i-1), gamma^i], so the
+// percentiles are known with a relative error of SketchAccuracy. Sketches
+// are merged by adding the counts of their bins, the merged sketch is the
+// same as the one of all the values.
+type sketch struct {
+	zero     uint64
+	positive sketchStore
+	negative sketchStore // bins of the negated values
+}
+
+// sketchStore holds the counts of a range of bins.
+type sketchStore struct {
+	offset int32 // bin of counts[0]
+	counts []uint64
+}
+
+// newSketch returns the sketch of a single value.
+func newSketch(v float64) *sketch {
+	s := &sketch{}
+	s.add(v)
+	return s
+}
+
+// sketchKey returns the bin of a value greater than 0.
+func sketchKey(v float64) int32 {
+	return int32(math.Ceil(math.Log(v) / sketchLogGamma))
+}
+
+// add adds a value to the sketch, NaN is left out.
+func (s *sketch) add(v float64) {
+	switch {
+	case math.IsNaN(v):
+	case v == 0:
+		s.zero++
+	case math.IsInf(v, 1):
+		s.positive.add(sketchMaxKey, 1)
+	case math.IsInf(v, -1):
+		s.negative.add(sketchMaxKey, 1)
+	case v > 0:
+		s.positive.add(sketchKey(v), 1)
+	default:
+		s.negative.add(sketchKey(-v), 1)
+	}
+}
+
+// merge adds the values of o to s.
+func (s *sketch) merge(o *sketch) {
+	if o == nil {
+		return
+	}
+	s.zero += o.zero
+	s.positive.merge(&o.positive)
+	s.negative.merge(&o.negative)
+}
+
+// clone returns a copy of s which can be merged into without changing s.
+func (s *sketch) clone() *sketch {
+	if s == nil {
+		return &sketch{}
+	}
+	c := &sketch{zero: s.zero}
+	c.positive.merge(&s.positive)
+	c.negative.merge(&s.negative)
+	return c
+}
+
+// count returns the number of values in the sketch.
+func (s *sketch) count() uint64 {
+	return s.zero + s.positive.count() + s.negative.count()
+}
+
+// quantile returns the value which q of the values are less than or equal
+// to, q being between 0 and 1.
+func (s *sketch) quantile(q float64) float64 {
+	n := s.count()
+	if n == 0 {
+		return 0
+	}
+	rank := q * float64(n-1)
+
+	var seen uint64
+	for i := len(s.negative.counts) - 1; i >= 0; i-- {
+		seen += s.negative.counts[i]
+		if float64(seen) > rank {
+			return -sketchValue(s.negative.offset + int32(i))
+		}
+	}
+	seen += s.zero
+	if float64(seen) > rank {
+		return 0
+	}
+	for i, c := range s.positive.counts {
+		seen += c
+		if float64(seen) > rank {
+			return sketchValue(s.positive.offset + int32(i))
+		}
+	}
+	return sketchValue(s.positive.offset + int32(len(s.positive.counts)-1))
+}
+
+// sketchValue returns the value within SketchAccuracy of every value of a
+// bin.
+func sketchValue(key int32) float64 {
+	return 2 * math.Pow(sketchGamma, float64(key)) / (sketchGamma + 1)
+}
+
+func (st *sketchStore) add(key int32, count uint64) {
+	st.extend(key, key)
+	st.counts[st.index(key)] += count
+}
+
+func (st *sketchStore) merge(o *sketchStore) {
+	if len(o.counts) == 0 {
+		return
+	}
+	st.extend(o.offset, o.offset+int32(len(o.counts))-1)
+	for i, c := range o.counts {
+		if c != 0 {
+			st.counts[st.index(o.offset+int32(i))] += c
+		}
+	}
+}
+
+// index returns the index of the count of a bin in the range of st, the
+// bins below the range are counted in the lowest one.
+func (st *sketchStore) index(key int32) int {
+	if key < st.offset {
+		return 0
+	}
+	return int(key - st.offset)
+}
+
+// extend makes the range of st hold the bins from lo to hi. The range is
+// at most sketchMaxBins long, the lowest bins are merged if it is longer.
+func (st *sketchStore) extend(lo, hi int32) {
+	top := st.offset + int32(len(st.counts)) - 1
+	if len(st.counts) != 0 {
+		if st.offset < lo {
+			lo = st.offset
+		}
+		if top > hi {
+			hi = top
+		}
+	}
+	if hi-lo >= sketchMaxBins {
+		lo = hi - sketchMaxBins + 1
+	}
+	if len(st.counts) != 0 && lo == st.offset && hi == top {
+		return
+	}
+
+	counts := make([]uint64, hi-lo+1)
+	for i, c := range st.counts {
+		key := st.offset + int32(i)
+		if key < lo {
+			key = lo
+		}
+		counts[key-lo] += c
+	}
+	st.offset = lo
+	st.counts = counts
+}
+
+func (st *sketchStore) count() uint64 {
+	var n uint64
+	for _, c := range st.counts {
+		n += c
+	}
+	return n
+}
+
+func (s *sketch) encode() []byte {
+	buf := new(bytes.Buffer)
+	writeUvarint(buf, s.zero)
+	s.positive.encode(buf)
+	s.negative.encode(buf)
+	return buf.Bytes()
+}
+
+func (st *sketchStore) encode(buf *bytes.Buffer) {
+	writeUvarint(buf, uint64(len(st.counts)))
+	if len(st.counts) == 0 {
+		return
+	}
+	tmp := make([]byte, binary.MaxVarintLen64)
+	buf.Write(tmp[:binary.PutVarint(tmp, int64(st.offset))])
+	for _, c := range st.counts {
+		writeUvarint(buf, c)
+	}
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	buf.Write(tmp[:binary.PutUvarint(tmp, v)])
+}
+
+// decodeSketch decodes a sketch from the beginning of data, it returns the
+// number of bytes read.
+func decodeSketch(data []byte) (*sketch, int, error) {
+	s := &sketch{}
+	r := bytes.NewReader(data)
+	var err error
+	if s.zero, err = binary.ReadUvarint(r); err != nil {
+		return nil, 0, ErrInvalid
+	}
+	for _, st := range []*sketchStore{&s.positive, &s.negative} {
+		length, err := binary.ReadUvarint(r)
+		if err != nil || length > sketchMaxBins {
+			return nil, 0, ErrInvalid
+		}
+		if length == 0 {
+			continue
+		}
+		offset, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, 0, ErrInvalid
+		}
+		st.offset = int32(offset)
+		st.counts = make([]uint64, length)
+		for i := range st.counts {
+			if st.counts[i], err = binary.ReadUvarint(r); err != nil {
+				return nil, 0, ErrInvalid
+			}
+		}
+	}
+	return s, len(data) - r.Len(), nil
+}
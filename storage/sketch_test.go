@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// checkQuantiles checks the quantiles of s against the sorted values.
+func checkQuantiles(t *testing.T, s *sketch, sorted []float64) {
+	t.Helper()
+	for _, q := range []float64{0, 0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999, 1} {
+		want := sorted[int(q*float64(len(sorted)-1))]
+		got := s.quantile(q)
+		if math.Abs(got-want) > SketchAccuracy*math.Abs(want)+1e-12 {
+			t.Fatalf("quantile %v: expected %v, got %v", q, want, got)
+		}
+	}
+}
+
+func TestSketchQuantile(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	s := &sketch{}
+	var values []float64
+	for i := 0; i < 10000; i++ {
+		v := math.Exp(r.NormFloat64())
+		switch i % 10 {
+		case 0:
+			v = -v
+		case 1:
+			v = 0
+		}
+		s.add(v)
+		values = append(values, v)
+	}
+	sort.Float64s(values)
+
+	if n := s.count(); n != 10000 {
+		t.Fatalf("expected 10000 values, got %d", n)
+	}
+	checkQuantiles(t, s, values)
+}
+
+func TestSketchMerge(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	all := &sketch{}
+	parts := make([]*sketch, 7)
+	for i := range parts {
+		parts[i] = &sketch{}
+	}
+	for i := 0; i < 5000; i++ {
+		v := r.NormFloat64() * math.Pow(10, float64(r.Intn(12)-4))
+		all.add(v)
+		parts[r.Intn(len(parts))].add(v)
+	}
+
+	merged := parts[0].clone()
+	before := parts[1].encode()
+	for _, p := range parts[1:] {
+		merged.merge(p)
+	}
+	if !bytes.Equal(merged.encode(), all.encode()) {
+		t.Fatal("expected the merged sketch to be the sketch of all values")
+	}
+	if !bytes.Equal(parts[1].encode(), before) {
+		t.Fatal("expected the merged sketch to be unchanged")
+	}
+	if l := len(all.positive.counts); l != sketchMaxBins {
+		t.Fatalf("expected the range of %d bins to be collapsed, got %d", sketchMaxBins, l)
+	}
+}
+
+func TestSketchEncode(t *testing.T) {
+	s := &sketch{}
+	for _, v := range []float64{0, 1, -1, 1e-300, 1e300, math.Inf(1), math.Inf(-1), math.NaN(), 42.5} {
+		s.add(v)
+	}
+	data := append(s.encode(), 0xff)
+	decoded, n, err := decodeSketch(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(data)-1 {
+		t.Fatalf("expected %d bytes to be read, got %d", len(data)-1, n)
+	}
+	if !bytes.Equal(decoded.encode(), s.encode()) {
+		t.Fatal("expected the decoded sketch to be the same")
+	}
+	if c := decoded.count(); c != 8 {
+		t.Fatalf("expected 8 values, got %d", c)
+	}
+	if _, _, err := decodeSketch(data[:len(data)/2]); err != ErrInvalid {
+		t.Fatalf("expected ErrInvalid, got %v", err)
+	}
+}
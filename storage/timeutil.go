@@ -6,76 +6,72 @@ import (
 
 const TimeFormat string = "2006-01-02 15:04:05"
 
+// Time is a timestamp with the calendar of the time zone it is bucketed in.
 type Time struct {
-	Time time.Time
-	TS   int64
+	Time  time.Time
+	TS    int64
+	level uint16
 }
 
+// NewTime returns the time tm, bucketed in UTC.
 func NewTime(tm int64) Time {
-	t := time.Unix(0, tm)
+	return NewTimeIn(tm, time.UTC)
+}
+
+// NewTimeIn returns the time tm, bucketed in the time zone loc.
+func NewTimeIn(tm int64, loc *time.Location) Time {
+	t := timeIn(tm, loc)
+	t.level = LevelNSecond
+	for _, level := range []uint16{LevelYear, LevelMonth, LevelDay, LevelHour, LevelMinute, LevelSecond, LevelMSecond, LevelUSecond} {
+		if t.Timestamp(level) == tm {
+			t.level = level
+			break
+		}
+	}
+	return t
+}
+
+// timeIn returns the time tm in loc without its level, for callers which
+// only need Timestamp.
+func timeIn(tm int64, loc *time.Location) Time {
 	return Time{
-		Time: t,
+		Time: time.Unix(0, tm).In(loc),
 		TS:   tm,
 	}
 }
 
+// Level returns the coarsest level t is the start of a period of.
 func (t *Time) Level() uint16 {
-	if t.Time.Nanosecond()%1e3 != 0 {
-		return LevelNSecond
-	}
-	if t.Time.Nanosecond()%1e6 != 0 {
-		return LevelUSecond
-	}
-	if t.Time.Nanosecond()%1e9 != 0 {
-		return LevelMSecond
-	}
-	if t.Time.Second() != 0 {
-		return LevelSecond
-	}
-	if t.Time.Minute() != 0 {
-		return LevelMinute
-	}
-	if t.Time.Hour() != 0 {
-		return LevelHour
-	}
-	if t.Time.Day() != 1 {
-		return LevelDay
-	}
-	if t.Time.Month() != 1 {
-		return LevelMonth
-	}
-	return LevelYear
+	return t.level
 }
 
+// Timestamp returns the start of the period of the level t is in.
 func (t *Time) Timestamp(level uint16) int64 {
-	var tp string
-	var tm time.Time
+	year, month, day := t.Time.Date()
+	loc := t.Time.Location()
 	switch level {
 	case LevelYear:
-		tp = t.Time.Format("2006")
-		tm, _ = time.ParseInLocation(TimeFormat, tp+"-01-01 00:00:00", time.Local)
+		return time.Date(year, 1, 1, 0, 0, 0, 0, loc).UnixNano()
 	case LevelMonth:
-		tp = t.Time.Format("2006-01")
-		tm, _ = time.ParseInLocation(TimeFormat, tp+"-01 00:00:00", time.Local)
+		return time.Date(year, month, 1, 0, 0, 0, 0, loc).UnixNano()
 	case LevelDay:
-		tp = t.Time.Format("2006-01-02 00:00:00")
-		tm, _ = time.ParseInLocation(TimeFormat, tp, time.Local)
+		return time.Date(year, month, day, 0, 0, 0, 0, loc).UnixNano()
+	}
+
+	// Below a day the elapsed wall clock time is subtracted instead, so the
+	// hour repeated when daylight saving time ends is a period of its own.
+	nsec := int64(t.Time.Nanosecond())
+	switch level {
 	case LevelHour:
-		tp = t.Time.Format("2006-01-02 15:00:00")
-		tm, _ = time.ParseInLocation(TimeFormat, tp, time.Local)
+		return t.TS - int64(t.Time.Minute())*int64(time.Minute) - int64(t.Time.Second())*int64(time.Second) - nsec
 	case LevelMinute:
-		tp = t.Time.Format("2006-01-02 15:04:00")
-		tm, _ = time.ParseInLocation(TimeFormat, tp, time.Local)
+		return t.TS - int64(t.Time.Second())*int64(time.Second) - nsec
 	case LevelSecond:
-		tp = t.Time.Format("2006-01-02 15:04:05")
-		tm, _ = time.ParseInLocation(TimeFormat, tp, time.Local)
+		return t.TS - nsec
 	case LevelMSecond:
-		tm = time.Unix(0, (t.Time.UnixNano()/1e6)*1e6)
+		return t.TS - nsec%1e6
 	case LevelUSecond:
-		tm = time.Unix(0, (t.Time.UnixNano()/1e3)*1e3)
-	default:
-		tm = t.Time
+		return t.TS - nsec%1e3
 	}
-
-	return tm.UnixNano()
+	return t.TS
 }
@@ -0,0 +1,389 @@
+package storage
+
+import (
+	"bytes"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	txLogSlotSize   int64 = 32
+	txLogHeaderSize int64 = 2 * txLogSlotSize
+)
+
+// TxLog decides the outcome of transactions spanning several databases.
+// Every database taking part in such transactions must be opened with the
+// log in Options.TxLog, so that a transaction prepared in its write-ahead
+// log is only replayed if it was committed.
+//
+// The file holds two alternating state slots with the last handed out and the
+// last committed transaction id, followed by the ids of aborted transactions.
+type TxLog struct {
+	ops        Ops
+	commitLock sync.Mutex // Allows only one commit at a time.
+	lock       sync.Mutex // protects the state below
+
+	seq       uint64 // sequence of the last written state slot
+	txid      uint64 // last transaction id handed out
+	committed uint64 // last committed transaction id
+	aborted   map[uint64]bool
+	pos       int64 // end of the aborted ids
+	err       error // set once the log cannot record an abort
+}
+
+// OpenTxLog opens the transaction log at path, creating it if needed. The
+// file is locked exclusively like a database, only Timeout and Mode of the
+// options are used.
+// A transaction which was handed out but not committed before the last
+// shutdown is aborted.
+func OpenTxLog(path string, options *Options) (*TxLog, error) {
+	if options == nil {
+		options = DefaultOptions
+	}
+	l := &TxLog{aborted: make(map[uint64]bool)}
+
+	var err error
+	if _, err = l.ops.OpenFile(path, os.O_RDWR|os.O_CREATE, options.fileMode()); err != nil {
+		return nil, err
+	}
+	if err = flock(l.ops.File, true, options.Timeout); err != nil {
+		l.ops.Close()
+		return nil, err
+	}
+
+	size, err := l.ops.GotoEOF()
+	if err != nil {
+		l.ops.Close()
+		return nil, err
+	}
+	if size == 0 {
+		// Fill both slots like Open does for a new database.
+		for i := 0; i < 2; i++ {
+			if err = l.writeState(); err != nil {
+				l.ops.Close()
+				return nil, err
+			}
+		}
+		l.pos = txLogHeaderSize
+		return l, nil
+	}
+	if size < txLogHeaderSize {
+		l.ops.Close()
+		return nil, ErrInvalid
+	}
+
+	if err = l.load(); err != nil {
+		l.ops.Close()
+		return nil, err
+	}
+	if l.txid > l.committed && !l.aborted[l.txid] {
+		if err = l.abort(l.txid); err != nil {
+			l.ops.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// load reads the newest valid state slot and the aborted ids.
+func (l *TxLog) load() error {
+	buf := make([]byte, txLogHeaderSize)
+	if _, err := l.ops.ReadAt(buf, 0); err != nil {
+		return err
+	}
+
+	valid := false
+	for slot := int64(0); slot < 2; slot++ {
+		b := buf[slot*txLogSlotSize : (slot+1)*txLogSlotSize]
+		seq := decodeUint64(b[0:8])
+		if txLogChecksum(b[0:24]) != decodeUint64(b[24:32]) {
+			continue
+		}
+		if !valid || seq > l.seq {
+			l.seq = seq
+			l.txid = decodeUint64(b[8:16])
+			l.committed = decodeUint64(b[16:24])
+			valid = true
+		}
+	}
+	if !valid {
+		return ErrChecksum
+	}
+
+	pos := txLogHeaderSize
+	for {
+		record, err := readChunk(&l.ops, pos)
+		if err == io.EOF || err == ErrChunkBadCrc || err == ErrChunkDataLessThanSize {
+			break
+		} else if err != nil {
+			return err
+		}
+		if len(record) == 8 {
+			l.aborted[decodeUint64(record)] = true
+		}
+		pos += chunkSize(record)
+	}
+	l.pos = pos
+	return l.ops.Truncate(pos)
+}
+
+// writeState writes the ids into the slot after the current one.
+func (l *TxLog) writeState() error {
+	l.seq++
+	buf := new(bytes.Buffer)
+	buf.Write(encodeUint64(l.seq))
+	buf.Write(encodeUint64(l.txid))
+	buf.Write(encodeUint64(l.committed))
+	buf.Write(encodeUint64(txLogChecksum(buf.Bytes())))
+
+	if _, err := l.ops.WriteAt(buf.Bytes(), int64(l.seq%2)*txLogSlotSize); err != nil {
+		return err
+	}
+	return l.ops.Sync()
+}
+
+func txLogChecksum(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+// Committed returns whether the transaction txid was committed.
+func (l *TxLog) Committed(txid uint64) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return txid <= l.committed && !l.aborted[txid]
+}
+
+// reserve hands out the next transaction id, it is on disk before it is used
+// so an id is never handed out twice.
+func (l *TxLog) reserve() (uint64, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.err != nil {
+		return 0, l.err
+	}
+	l.txid++
+	if err := l.writeState(); err != nil {
+		return 0, err
+	}
+	return l.txid, nil
+}
+
+// commit records the decision to commit txid.
+func (l *TxLog) commit(txid uint64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.committed = txid
+	return l.writeState()
+}
+
+// abort records the decision to abort txid. If that fails the outcome of txid
+// is unknown, the log refuses further transactions until it is reopened.
+func (l *TxLog) abort(txid uint64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	chunk := encodeChunk(encodeUint64(txid))
+	n, err := l.ops.WriteAt(chunk, l.pos)
+	if err == nil {
+		err = l.ops.Sync()
+	}
+	if err != nil {
+		l.err = err
+		return err
+	}
+	l.pos += int64(n)
+	l.aborted[txid] = true
+	return nil
+}
+
+// Close closes the log file.
+func (l *TxLog) Close() error {
+	return l.ops.Close()
+}
+
+// Tx is a set of changes to one or more databases, which are applied all
+// together by Commit or not at all.
+type Tx struct {
+	log     *TxLog
+	dbs     []*DB
+	records map[*DB][][]byte
+	done    bool
+}
+
+// Begin starts a transaction.
+func (l *TxLog) Begin() *Tx {
+	return &Tx{
+		log:     l,
+		records: make(map[*DB][][]byte),
+	}
+}
+
+// Put adds the insertion of a point into db to the transaction.
+func (tx *Tx) Put(db *DB, key int64, value map[string]float64) error {
+	return tx.add(db, encodePutRecord(key, value))
+}
+
+// PutBatch adds the insertion of points into db to the transaction.
+func (tx *Tx) PutBatch(db *DB, points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+	return tx.add(db, encodeBatchRecord(sortPoints(points)))
+}
+
+// Delete adds the removal of the points in [from, to) of db to the transaction.
+func (tx *Tx) Delete(db *DB, from int64, to int64) error {
+	return tx.add(db, encodeDeleteRecord(from, to))
+}
+
+func (tx *Tx) add(db *DB, record []byte) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if _, ok := tx.records[db]; !ok {
+		tx.dbs = append(tx.dbs, db)
+	}
+	tx.records[db] = append(tx.records[db], record)
+	return nil
+}
+
+// Rollback drops the changes of the transaction.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	tx.done = true
+	tx.records = nil
+	return nil
+}
+
+// Commit applies the changes of the transaction. The changes of a single
+// database are logged as one record. With more databases they are prepared
+// in every write-ahead log first, and committed once the decision is written
+// to the transaction log.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	tx.done = true
+	if len(tx.dbs) == 0 {
+		return nil
+	}
+
+	l := tx.log
+	l.commitLock.Lock()
+	defer l.commitLock.Unlock()
+
+	// Lock the databases in the same order in every transaction.
+	dbs := make([]*DB, len(tx.dbs))
+	copy(dbs, tx.dbs)
+	sort.Slice(dbs, func(i, j int) bool {
+		return dbs[i].path < dbs[j].path
+	})
+	for _, db := range dbs {
+		db.rwlock.Lock()
+		defer db.rwlock.Unlock()
+	}
+	for _, db := range dbs {
+		if !db.opened {
+			return ErrDatabaseNotOpen
+		}
+		if db.readOnly {
+			return ErrDatabaseReadOnly
+		}
+	}
+
+	if len(dbs) == 1 {
+		db := dbs[0]
+		if err := db.wal.append(encodeTxRecord(0, tx.records[db])); err != nil {
+			return err
+		}
+		return db.applyTx(tx.records[db])
+	}
+
+	for _, db := range dbs {
+		if db.txlog != l {
+			return ErrTxLogMismatch
+		}
+	}
+	txid, err := l.reserve()
+	if err != nil {
+		return err
+	}
+
+	// Phase one, the prepared records must be on disk before the commit.
+	for _, db := range dbs {
+		if err := db.wal.write(encodeTxRecord(txid, tx.records[db]), true); err != nil {
+			l.abort(txid)
+			return err
+		}
+	}
+
+	// Phase two.
+	if err := l.commit(txid); err != nil {
+		l.abort(txid)
+		return err
+	}
+	for _, db := range dbs {
+		if err := db.applyTx(tx.records[db]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyTx applies the records of a transaction to the tree.
+func (db *DB) applyTx(records [][]byte) error {
+	for _, record := range records {
+		if err := db.apply(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeTxRecord encodes the records of a transaction. Records of a single
+// database transaction have the txid 0, they do not depend on the TxLog.
+func encodeTxRecord(txid uint64, records [][]byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(walTx)
+	buf.Write(encodeUint64(txid))
+	buf.Write(encodeUint32(uint32(len(records))))
+	for _, record := range records {
+		buf.Write(encodeUint32(uint32(len(record))))
+		buf.Write(record)
+	}
+	return buf.Bytes()
+}
+
+// decodeTxRecord decodes a record written by encodeTxRecord.
+func decodeTxRecord(record []byte) (uint64, [][]byte, error) {
+	if len(record) < 13 {
+		return 0, nil, ErrLogCorrupted
+	}
+	txid := decodeUint64(record[1:9])
+	count := int(decodeUint32(record[9:13]))
+	records := make([][]byte, 0, count)
+
+	bufPos := 13
+	for i := 0; i < count; i++ {
+		if bufPos+4 > len(record) {
+			return 0, nil, ErrLogCorrupted
+		}
+		length := int(decodeUint32(record[bufPos : bufPos+4]))
+		bufPos += 4
+		if length == 0 || bufPos+length > len(record) {
+			return 0, nil, ErrLogCorrupted
+		}
+		records = append(records, record[bufPos:bufPos+length])
+		bufPos += length
+	}
+	return txid, records, nil
+}
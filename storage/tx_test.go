@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTx opens the transaction log and two databases in dir.
+func openTx(t *testing.T, dir string) (*TxLog, *DB, *DB) {
+	l, err := OpenTxLog(filepath.Join(dir, "txlog"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := &Options{TxLog: l}
+	open, err := Open(filepath.Join(dir, "open"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close, err := Open(filepath.Join(dir, "close"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, open, close
+}
+
+func TestTxCommit(t *testing.T) {
+	dir := t.TempDir()
+	l, open, close := openTx(t, dir)
+
+	key := time.Date(2016, 8, 28, 21, 24, 0, 0, time.UTC).UnixNano()
+	tx := l.Begin()
+	tx.Put(open, key, map[string]float64{"AAPL": 10.1})
+	tx.PutBatch(close, []Point{{Timestamp: key, Value: map[string]float64{"AAPL": 10.2}}})
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != ErrTxClosed {
+		t.Fatalf("expected ErrTxClosed, got %v", err)
+	}
+
+	// Reopen without flushing, the transaction is replayed in both.
+	crash(t, open, close)
+	l.Close()
+	l, open, close = openTx(t, dir)
+	for _, db := range []*DB{open, close} {
+		if _, err := db.Get(key); err != nil {
+			t.Fatalf("%s: %v", db.Path(), err)
+		}
+	}
+}
+
+func TestTxPrepared(t *testing.T) {
+	dir := t.TempDir()
+	l, open, close := openTx(t, dir)
+
+	// Crash after the records were prepared, before the commit.
+	key := time.Date(2016, 8, 28, 21, 24, 0, 0, time.UTC).UnixNano()
+	txid, err := l.reserve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, db := range []*DB{open, close} {
+		record := encodeTxRecord(txid, [][]byte{encodePutRecord(key, map[string]float64{"AAPL": 1})})
+		if err := db.wal.write(record, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	crash(t, open, close)
+	l.Close()
+	l, open, close = openTx(t, dir)
+	for _, db := range []*DB{open, close} {
+		if _, err := db.Get(key); err != ErrNotFound {
+			t.Fatalf("%s: expected ErrNotFound, got %v", db.Path(), err)
+		}
+	}
+
+	// Later transactions do not commit the aborted one.
+	tx := l.Begin()
+	tx.Put(open, key+int64(time.Minute), map[string]float64{"AAPL": 2})
+	tx.Put(close, key+int64(time.Minute), map[string]float64{"AAPL": 2})
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	crash(t, open, close)
+	l.Close()
+	l, open, close = openTx(t, dir)
+	for _, db := range []*DB{open, close} {
+		if _, err := db.Get(key); err != ErrNotFound {
+			t.Fatalf("%s: expected ErrNotFound, got %v", db.Path(), err)
+		}
+		if _, err := db.Get(key + int64(time.Minute)); err != nil {
+			t.Fatalf("%s: %v", db.Path(), err)
+		}
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	l, open, close := openTx(t, t.TempDir())
+
+	key := time.Date(2016, 8, 28, 21, 24, 0, 0, time.UTC).UnixNano()
+	tx := l.Begin()
+	tx.Put(open, key, map[string]float64{"AAPL": 1})
+	tx.Put(close, key, map[string]float64{"AAPL": 1})
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != ErrTxClosed {
+		t.Fatalf("expected ErrTxClosed, got %v", err)
+	}
+	for _, db := range []*DB{open, close} {
+		if _, err := db.Get(key); err != ErrNotFound {
+			t.Fatalf("%s: expected ErrNotFound, got %v", db.Path(), err)
+		}
+	}
+}
+
+func TestTxLogMismatch(t *testing.T) {
+	dir := t.TempDir()
+	l, open, _ := openTx(t, dir)
+	other, err := Open(filepath.Join(dir, "other"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	tx := l.Begin()
+	tx.Put(open, 1, map[string]float64{"AAPL": 1})
+	tx.Put(other, 1, map[string]float64{"AAPL": 1})
+	if err := tx.Commit(); err != ErrTxLogMismatch {
+		t.Fatalf("expected ErrTxLogMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncPolicy controls when the write-ahead log is fsynced to disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs the log before Put or Delete returns.
+	SyncAlways SyncPolicy = iota
+
+	// SyncInterval fsyncs the log in the background every Options.SyncInterval,
+	// a crash may lose the writes of the last interval.
+	SyncInterval
+
+	// SyncNever leaves flushing the log to the operating system.
+	SyncNever
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	}
+	return "unknown"
+}
+
+// WALSuffix is appended to the path of a database to name its write-ahead log.
+const WALSuffix = ".wal"
+
+// Operations recorded in the write-ahead log.
+const (
+	walPut    byte = 0x01
+	walDelete byte = 0x02
+	walBatch  byte = 0x03
+	walTx     byte = 0x04
+)
+
+// wal is the write-ahead log of a database. Every change of the in-memory
+// tree is appended to it as a chunk before it is applied, and the log is
+// truncated once Flush has written the tree to the database file.
+type wal struct {
+	ops    Ops
+	pos    int64
+	policy SyncPolicy
+	dirty  bool       // appended since the last fsync
+	lock   sync.Mutex // protects the file between writers and the syncer
+
+	closing chan struct{}
+	closed  chan struct{}
+}
+
+func openWAL(path string, options *Options) (*wal, error) {
+	w := &wal{policy: options.SyncPolicy}
+
+	var err error
+	if _, err = w.ops.OpenFile(path, os.O_RDWR|os.O_CREATE, options.fileMode()); err != nil {
+		return nil, err
+	}
+
+	if w.policy == SyncInterval {
+		interval := options.SyncInterval
+		if interval <= 0 {
+			interval = DefaultOptions.SyncInterval
+		}
+		w.closing = make(chan struct{})
+		w.closed = make(chan struct{})
+		go w.syncLoop(interval)
+	}
+	return w, nil
+}
+
+// replay reads every complete record of the log and passes it to fn. A torn
+// record at the end of the log is the remains of a crash during append, the
+// log is truncated before it.
+func (w *wal) replay(fn func(record []byte) error) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	pos, err := w.read(fn)
+	if err != nil {
+		return err
+	}
+	w.pos = pos
+	return w.ops.Truncate(pos)
+}
+
+// read passes every complete record to fn and returns the end of the last one.
+func (w *wal) read(fn func(record []byte) error) (int64, error) {
+	var pos int64
+	for {
+		record, err := readChunk(&w.ops, pos)
+		if err == io.EOF || err == ErrChunkBadCrc || err == ErrChunkDataLessThanSize {
+			return pos, nil
+		} else if err != nil {
+			return pos, err
+		}
+		if err = fn(record); err != nil {
+			return pos, err
+		}
+		pos += chunkSize(record)
+	}
+}
+
+// readWAL passes the records of the log at path to fn without changing the
+// file, it is used by read-only databases. A missing log has no records.
+func readWAL(path string, fn func(record []byte) error) error {
+	w := &wal{}
+	if _, err := w.ops.OpenFile(path, os.O_RDONLY, 0); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer w.ops.Close()
+
+	_, err := w.read(fn)
+	return err
+}
+
+// put appends the insertion of a point.
+func (w *wal) put(key int64, value map[string]float64) error {
+	return w.append(encodePutRecord(key, value))
+}
+
+// delete appends the removal of the points between from and to.
+func (w *wal) delete(from int64, to int64) error {
+	return w.append(encodeDeleteRecord(from, to))
+}
+
+func encodePutRecord(key int64, value map[string]float64) []byte {
+	p := &Point{Timestamp: key, Value: value}
+	return append([]byte{walPut}, p.encode()...)
+}
+
+func encodeDeleteRecord(from int64, to int64) []byte {
+	record := []byte{walDelete}
+	record = append(record, encodeInt64(from)...)
+	record = append(record, encodeInt64(to)...)
+	return record
+}
+
+// append appends a record and fsyncs it according to the sync policy.
+func (w *wal) append(record []byte) error {
+	return w.write(record, w.policy == SyncAlways)
+}
+
+// write appends a record, it is fsynced before write returns if sync is set.
+func (w *wal) write(record []byte, sync bool) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	chunk := encodeChunk(record)
+	n, err := w.ops.WriteAt(chunk, w.pos)
+	if err != nil {
+		// Cut off the partial record, otherwise later appends end up behind it.
+		_ = w.ops.Truncate(w.pos)
+		return err
+	}
+	w.pos += int64(n)
+
+	if sync {
+		return w.ops.Sync()
+	}
+	w.dirty = true
+	return nil
+}
+
+// size returns the number of bytes logged since the last checkpoint.
+func (w *wal) size() int64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.pos
+}
+
+// checkpoint empties the log, it is called after the tree is safely on disk.
+func (w *wal) checkpoint() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := w.ops.Truncate(0); err != nil {
+		return err
+	}
+	w.pos = 0
+	w.dirty = false
+	if w.policy == SyncNever {
+		return nil
+	}
+	return w.ops.Sync()
+}
+
+func (w *wal) syncLoop(interval time.Duration) {
+	defer close(w.closed)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.sync()
+		case <-w.closing:
+			return
+		}
+	}
+}
+
+func (w *wal) sync() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.ops.Sync()
+}
+
+func (w *wal) close() error {
+	if w.closing != nil {
+		close(w.closing)
+		<-w.closed
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	var err error
+	if w.dirty && w.policy != SyncNever {
+		err = w.ops.Sync()
+	}
+	if cerr := w.ops.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWALReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	db, err := Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Date(2016, 8, 28, 21, 24, 0, 0, time.UTC).UnixNano()
+	for i := 0; i < 100; i++ {
+		if err := db.Put(base+int64(i)*int64(time.Second), map[string]float64{"price": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if i == 49 {
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Delete(base+int64(90*time.Second), base+int64(95*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen without flushing, as after a crash.
+	crash(t, db)
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		p, err := db.Get(base + int64(i)*int64(time.Second))
+		if i >= 90 && i < 95 {
+			if err != ErrNotFound {
+				t.Fatalf("point %d: expected ErrNotFound, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("point %d: %v", i, err)
+		}
+		if p.Value["price"] != float64(i) {
+			t.Fatalf("point %d: unexpected value %v", i, p.Value)
+		}
+	}
+}
+
+func TestWALTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	db, err := Open(path, &Options{SyncPolicy: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := time.Date(2016, 8, 28, 21, 24, 0, 0, time.UTC).UnixNano()
+	if err := db.Put(key, map[string]float64{"price": 1}); err != nil {
+		t.Fatal(err)
+	}
+	size := db.wal.size()
+	crash(t, db)
+
+	// Append half a record, as left by a crash in the middle of a write.
+	f, err := os.OpenFile(path+WALSuffix, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encodeChunk([]byte{walPut, 1, 2, 3, 4, 5, 6, 7, 8})[:10])
+	f.Close()
+
+	db, err = Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get(key); err != nil {
+		t.Fatal(err)
+	}
+	if s := db.wal.size(); s != size {
+		t.Fatalf("expected torn record to be truncated to %d, got %d", size, s)
+	}
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	db, err := Open(path, &Options{SyncPolicy: SyncInterval, SyncInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	key := time.Date(2016, 8, 28, 21, 24, 0, 0, time.UTC).UnixNano()
+	if err := db.Put(key, map[string]float64{"price": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if db.wal.size() == 0 {
+		t.Fatal("expected put to be logged")
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if s := db.wal.size(); s != 0 {
+		t.Fatalf("expected empty log after flush, got %d bytes", s)
+	}
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"math"
+	"time"
+)
+
+// WindowFunc is a function over the buckets of a query.
+type WindowFunc int
+
+const (
+	// MovingAverage is the average of the field in the last N buckets with
+	// it, the buckets before N are left out.
+	MovingAverage WindowFunc = iota + 1
+
+	// EMA is the exponential moving average of the field, weighting the
+	// bucket by Alpha and the average before by 1-Alpha.
+	EMA
+
+	// Derivative is the change of the field since the previous bucket with
+	// it, per Per.
+	Derivative
+
+	// NonNegativeDerivative is Derivative, the decreases are left out.
+	NonNegativeDerivative
+
+	// Difference is the change of the field since the previous bucket with
+	// it.
+	Difference
+
+	// CumulativeSum is the sum of the field in the buckets of the query up
+	// to the bucket.
+	CumulativeSum
+
+	// Rate is the increase per Per of a counter, a decrease being a reset
+	// of the counter to 0.
+	Rate
+)
+
+// emaWeight is the weight of the buckets before the query which EMA looks
+// back past.
+const emaWeight = 0.001
+
+// Window computes the field Name of the points of a query by a function of
+// the field Field of the buckets up to the point. The buckets before the
+// query the window needs are queried too, so the first points are the same
+// as the ones of a longer query.
+type Window struct {
+	Name  string
+	Field string
+	Func  WindowFunc
+
+	// N is the number of buckets of MovingAverage.
+	N int
+
+	// Alpha is the weight of a bucket in EMA, from 0 to 1.
+	Alpha float64
+
+	// Per is the unit of time of Derivative, NonNegativeDerivative and Rate,
+	// a second if it is 0.
+	Per time.Duration
+}
+
+// validate returns ErrInvalidWindow unless the options of w fit its
+// function.
+func (w *Window) validate() error {
+	switch w.Func {
+	case MovingAverage:
+		if w.N < 1 || w.N > MaxBuckets {
+			return ErrInvalidWindow
+		}
+	case EMA:
+		if !(w.Alpha > 0 && w.Alpha <= 1) {
+			return ErrInvalidWindow
+		}
+	case Derivative, NonNegativeDerivative, Rate:
+		if w.Per < 0 {
+			return ErrInvalidWindow
+		}
+	case Difference, CumulativeSum:
+	default:
+		return ErrInvalidWindow
+	}
+	if w.Name == "" || w.Field == "" {
+		return ErrInvalidWindow
+	}
+	return nil
+}
+
+// lookBack returns the number of buckets with the field before the query
+// which w needs.
+func (w *Window) lookBack() int {
+	switch w.Func {
+	case MovingAverage:
+		return w.N - 1
+	case EMA:
+		if w.Alpha == 1 {
+			return 0
+		}
+		n := math.Ceil(math.Log(emaWeight) / math.Log(1-w.Alpha))
+		if n > MaxBuckets {
+			return MaxBuckets
+		}
+		return int(n)
+	case CumulativeSum:
+		return 0
+	}
+	return 1
+}
+
+// apply sets the field Name of the points to the window, the points before
+// start are only looked back at.
+func (w *Window) apply(points []*Point, start int64) {
+	per := w.Per
+	if per == 0 {
+		per = time.Second
+	}
+
+	var prev *Point
+	var prevValue, sum, ema float64
+	var values []float64
+	for _, p := range points {
+		v, ok := p.Value[w.Field]
+		if !ok {
+			continue
+		}
+
+		switch w.Func {
+		case MovingAverage:
+			values = append(values, v)
+			sum += v
+			if len(values) > w.N {
+				sum -= values[0]
+				values = values[1:]
+			}
+			if len(values) == w.N {
+				p.Value[w.Name] = sum / float64(w.N)
+			}
+		case EMA:
+			if prev == nil {
+				ema = v
+			} else {
+				ema = w.Alpha*v + (1-w.Alpha)*ema
+			}
+			p.Value[w.Name] = ema
+		case Derivative, NonNegativeDerivative, Rate:
+			if prev != nil {
+				change := v - prevValue
+				if w.Func == Rate && change < 0 {
+					change = v
+				}
+				d := change * float64(per) / float64(p.Timestamp-prev.Timestamp)
+				if d >= 0 || w.Func == Derivative {
+					p.Value[w.Name] = d
+				}
+			}
+		case Difference:
+			if prev != nil {
+				p.Value[w.Name] = v - prevValue
+			}
+		case CumulativeSum:
+			if p.Timestamp >= start {
+				sum += v
+				p.Value[w.Name] = sum
+			}
+		}
+		prev, prevValue = p, v
+	}
+}
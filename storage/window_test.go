@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueryWindows(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "windows"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC)
+	hours := func(h int) int64 {
+		return base.Add(time.Duration(h) * time.Hour).UnixNano()
+	}
+	prices := []float64{1, 3, 2, 5, 4, 8, 6, 9, 7, 10}
+	for h, v := range prices {
+		if err := db.Put(hours(h), map[string]float64{"price": v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ema := make([]float64, len(prices))
+	for i, v := range prices {
+		ema[i] = v
+		if i > 0 {
+			ema[i] = 0.5*v + 0.5*ema[i-1]
+		}
+	}
+
+	// nan stands for a bucket without the window.
+	nan := math.NaN()
+	tests := []struct {
+		window Window
+		want   []float64
+	}{
+		{Window{Func: MovingAverage, N: 3}, []float64{17.0 / 3, 6, 23.0 / 3, 22.0 / 3, 26.0 / 3}},
+		{Window{Func: EMA, Alpha: 0.5}, ema[5:]},
+		{Window{Func: EMA, Alpha: 1}, prices[5:]},
+		{Window{Func: Difference}, []float64{4, -2, 3, -2, 3}},
+		{Window{Func: Derivative}, []float64{4.0 / 3600, -2.0 / 3600, 3.0 / 3600, -2.0 / 3600, 3.0 / 3600}},
+		{Window{Func: Derivative, Per: time.Hour}, []float64{4, -2, 3, -2, 3}},
+		{Window{Func: NonNegativeDerivative, Per: time.Hour}, []float64{4, nan, 3, nan, 3}},
+		{Window{Func: Rate, Per: time.Hour}, []float64{4, 6, 3, 7, 3}},
+		{Window{Func: CumulativeSum}, []float64{8, 14, 23, 30, 40}},
+	}
+	for _, test := range tests {
+		test.window.Name, test.window.Field = "window", "price"
+		options := &QueryOptions{Windows: []Window{test.window}}
+		points, err := db.Query(hours(5), hours(10), Group{Level: LevelHour}, map[string]string{"price": "last"}, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkWindow(t, test.window, points, hours(5), test.want)
+	}
+
+	invalid := []Window{
+		{Name: "window", Field: "price"},
+		{Name: "window", Field: "price", Func: MovingAverage},
+		{Name: "window", Field: "price", Func: EMA, Alpha: 1.5},
+		{Name: "window", Field: "price", Func: Rate, Per: -time.Hour},
+		{Field: "price", Func: Difference},
+	}
+	for _, w := range invalid {
+		_, err := db.Query(hours(5), hours(10), Group{Level: LevelHour}, map[string]string{"price": "last"}, &QueryOptions{Windows: []Window{w}})
+		if err != ErrInvalidWindow {
+			t.Fatalf("%+v: expected ErrInvalidWindow, got %v", w, err)
+		}
+	}
+}
+
+func TestQueryWindowsLookBack(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "windows"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC)
+	hours := func(h int) int64 {
+		return base.Add(time.Duration(h) * time.Hour).UnixNano()
+	}
+	for _, h := range []int{0, 10, 20, 30} {
+		if err := db.Put(hours(h), map[string]float64{"price": float64(h)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	window := Window{Name: "ma", Field: "price", Func: MovingAverage, N: 3}
+	reducer := map[string]string{"price": "last"}
+
+	// Without fill, the window looks back over the buckets with points.
+	options := &QueryOptions{Windows: []Window{window}}
+	points, err := db.Query(hours(25), hours(40), Group{Level: LevelHour}, reducer, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkWindow(t, window, points, hours(30), []float64{20})
+
+	// The filled buckets are looked back over too.
+	options = &QueryOptions{Fill: FillPrevious, Windows: []Window{window}}
+	points, err = db.Query(hours(30), hours(32), Group{Level: LevelHour}, reducer, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkWindow(t, window, points, hours(30), []float64{70.0 / 3, 80.0 / 3})
+}
+
+func TestQueryWindowsLookBackNull(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "windows"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC)
+	hours := func(h int) int64 {
+		return base.Add(time.Duration(h) * time.Hour).UnixNano()
+	}
+	for h := 0; h <= 10; h += 2 {
+		if err := db.Put(hours(h), map[string]float64{"price": float64(h)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every other bucket has no volume.
+	for h := 0; h <= 10; h += 4 {
+		if err := db.Put(hours(h)+1, map[string]float64{"volume": float64(h)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The buckets filled with null are not looked back over, nor the ones
+	// without the field.
+	nan := math.NaN()
+	reducer := map[string]string{"price": "last", "volume": "sum"}
+	tests := []struct {
+		window Window
+		fill   FillPolicy
+		from   int
+		want   []float64
+	}{
+		{Window{Name: "ma", Field: "price", Func: MovingAverage, N: 3}, FillNone, 10, []float64{8}},
+		{Window{Name: "ma", Field: "price", Func: MovingAverage, N: 3}, FillNull, 10, []float64{8, nan}},
+		{Window{Name: "ma", Field: "volume", Func: MovingAverage, N: 2}, FillNull, 8, []float64{6, nan}},
+	}
+	for _, test := range tests {
+		options := &QueryOptions{Fill: test.fill, Windows: []Window{test.window}}
+		points, err := db.Query(hours(test.from), hours(test.from+len(test.want)), Group{Level: LevelHour}, reducer, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkWindow(t, test.window, points, hours(test.from), test.want)
+	}
+}
+
+func TestQueryWindowsChain(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "windows"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Date(2016, 8, 28, 0, 0, 0, 0, time.UTC)
+	hours := func(h int) int64 {
+		return base.Add(time.Duration(h) * time.Hour).UnixNano()
+	}
+	for h, v := range []float64{1, 3, 2, 6} {
+		if err := db.Put(hours(h), map[string]float64{"price": v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second difference needs two buckets before the query.
+	windows := []Window{
+		{Name: "d", Field: "price", Func: Difference},
+		{Name: "dd", Field: "d", Func: Difference},
+	}
+	points, err := db.Query(hours(2), hours(4), Group{Level: LevelHour}, map[string]string{"price": "last"}, &QueryOptions{Windows: windows})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkWindow(t, windows[1], points, hours(2), []float64{-3, 5})
+}
+
+// checkWindow checks the window of the points, which start at first.
+func checkWindow(t *testing.T, w Window, points []*Point, first int64, want []float64) {
+	t.Helper()
+	if len(points) != len(want) {
+		t.Fatalf("%+v: expected %d buckets, got %d", w, len(want), len(points))
+	}
+	if len(points) > 0 && points[0].Timestamp != first {
+		t.Fatalf("%+v: expected the first bucket at %v, got %v", w, time.Unix(0, first).UTC(), time.Unix(0, points[0].Timestamp).UTC())
+	}
+	for i, want := range want {
+		v, ok := points[i].Value[w.Name]
+		if math.IsNaN(want) && ok || !math.IsNaN(want) && (!ok || math.Abs(v-want) > 1e-9) {
+			t.Fatalf("%+v, bucket %d: expected %v, got %v", w, i, want, points[i].Value)
+		}
+	}
+}